@@ -1,7 +1,10 @@
-package main
+package mysql
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
 )
 
 const (
@@ -137,35 +140,486 @@ type ResultSetRow struct {
 	Field1 StringLenEnc
 }
 
+// MarshalBinaryResultSetRow encodes one row of a COM_STMT_EXECUTE result set
+// in the binary protocol: https://dev.mysql.com/doc/internals/en/binary-protocol-resultset-row.html
+// values[i] is nil for a SQL NULL; otherwise it is the pre-encoded binary
+// representation of the column (fixed-width for numeric types,
+// length-encoded for everything else) matching the column's MYSQL_TYPE_*.
+func MarshalBinaryResultSetRow(values [][]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(0x00)
 
-func UnmarshalCommand(data []byte) interface{} {
+	bitmapLen := (len(values) + 7 + 2) / 8
+	bitmap := make([]byte, bitmapLen)
+	for i, v := range values {
+		if v == nil {
+			pos := i + 2
+			bitmap[pos/8] |= 1 << uint(pos%8)
+		}
+	}
+	buf.Write(bitmap)
+
+	for _, v := range values {
+		if v != nil {
+			buf.Write(v)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// EncodeLenEncBytes length-encodes b the same way a StringLenEnc field is
+// encoded on the wire: a length-encoded integer followed by the raw bytes.
+// Useful for building a value for MarshalBinaryResultSetRow from a
+// string-typed column.
+func EncodeLenEncBytes(b []byte) []byte {
+	var buf bytes.Buffer
+	writeIntVar(&buf, uint64(len(b)))
+	buf.Write(b)
+	return buf.Bytes()
+}
+
+// PreparedStatement tracks the server-side state of a statement created via
+// COM_STMT_PREPARE. It is kept alive (keyed by StatementId) for the lifetime
+// of the connection so that later COM_STMT_EXECUTE / COM_STMT_SEND_LONG_DATA /
+// COM_STMT_CLOSE / COM_STMT_RESET commands can refer back to it.
+type PreparedStatement struct {
+	StatementId uint32
+
+	// Query is the original MySQL query text with '?' placeholders, e.g.
+	// "SELECT * FROM t WHERE id = ?". RewrittenQuery is the same query with
+	// the placeholders translated to the backend's '$1, $2, ...' syntax.
+	Query          string
+	RewrittenQuery string
+
+	// RewriteArgs holds any values the dialect rewrite pulled out of Query
+	// and bound as RewrittenQuery's own positional parameters (e.g. a SHOW
+	// COLUMNS FROM table name); these are passed ahead of the client's own
+	// COM_STMT_EXECUTE parameters when running RewrittenQuery.
+	RewriteArgs []interface{}
+
+	NumParams  int
+	NumColumns int
+
+	// ParamTypes holds the MYSQL_TYPE_* (and unsigned flag) pair most
+	// recently supplied by the client for each parameter. It is only
+	// populated once a COM_STMT_EXECUTE sets new_params_bound_flag=1.
+	ParamTypes []StmtParamType
+
+	// LongData accumulates chunks delivered via COM_STMT_SEND_LONG_DATA,
+	// keyed by param index, to be consumed by the next COM_STMT_EXECUTE.
+	LongData map[int][]byte
+}
+
+type StmtParamType struct {
+	Type     uint8
+	Unsigned bool
+}
+
+// COM_STMT_PREPARE: https://dev.mysql.com/doc/internals/en/com-stmt-prepare.html
+type ComStmtPrepare struct {
+	Command Int1
+	Query   StringEOF
+}
+
+// COM_STMT_PREPARE_OK: https://dev.mysql.com/doc/internals/en/com-stmt-prepare-response.html#packet-COM_STMT_PREPARE_OK
+type StmtPrepareOK struct {
+	Status       Int1 // always 0x00
+	StatementId  Int4
+	NumColumns   Int2
+	NumParams    Int2
+	Reserved     Int1 // filler, always 0x00
+	WarningCount Int2
+}
+
+// COM_STMT_SEND_LONG_DATA: https://dev.mysql.com/doc/internals/en/com-stmt-send-long-data.html
+// NOTE: ParamData is everything remaining in the payload and has no
+// terminator, so it is a StringEOF and must stay the struct's last field.
+type ComStmtSendLongData struct {
+	Command     Int1
+	StatementId Int4
+	ParamId     Int2
+	ParamData   StringEOF
+}
+
+// COM_STMT_CLOSE: https://dev.mysql.com/doc/internals/en/com-stmt-close.html
+type ComStmtClose struct {
+	Command     Int1
+	StatementId Int4
+}
+
+// COM_STMT_RESET: https://dev.mysql.com/doc/internals/en/com-stmt-reset.html
+type ComStmtReset struct {
+	Command     Int1
+	StatementId Int4
+}
+
+// COM_STMT_FETCH: https://dev.mysql.com/doc/internals/en/com-stmt-fetch.html
+type ComStmtFetch struct {
+	Command     Int1
+	StatementId Int4
+	NumRows     Int4
+}
+
+// ComStmtExecute is the decoded form of COM_STMT_EXECUTE. Unlike the other
+// commands, its wire layout depends on NumParams from the referenced
+// PreparedStatement (the null-bitmap size and the optional per-param type
+// list), so it can't be produced by the generic Unmarshal reflection path
+// and is instead built up by unmarshalComStmtExecute below.
+type ComStmtExecute struct {
+	Command         Int1
+	StatementId     Int4
+	Flags           Int1
+	IterationCount  Int4
+	NullBitmap      []byte
+	NewParamsBound  bool
+	ParamTypes      []StmtParamType
+	// Params holds the raw encoded bytes for each parameter in binary
+	// protocol format; the caller decodes them once the statement's
+	// negotiated types are known (this may come from ParamTypes above or
+	// from the PreparedStatement's previously stored types).
+	Params [][]byte
+}
+
+// unmarshalComStmtExecute decodes a COM_STMT_EXECUTE payload given the
+// number of parameters bound to the referenced prepared statement.
+// prevTypes are the statement's stored param types, used to size each
+// param when the packet does not bind new ones.
+func unmarshalComStmtExecute(data []byte, numParams int, prevTypes []StmtParamType) (ComStmtExecute, error) {
+	var c ComStmtExecute
+	if len(data) < 10 {
+		return c, io.ErrUnexpectedEOF
+	}
+
+	buf := bytes.NewBuffer(data)
+	c.Command = Int1(readInt1(buf))
+	c.StatementId = Int4(readInt4(buf))
+	c.Flags = Int1(readInt1(buf))
+	c.IterationCount = Int4(readInt4(buf))
+
+	if numParams > 0 {
+		bitmapLen := (numParams + 7) / 8
+		c.NullBitmap = make([]byte, bitmapLen)
+		if n, _ := buf.Read(c.NullBitmap); n != bitmapLen {
+			return c, io.ErrUnexpectedEOF
+		}
+
+		newParamsBound := readInt1(buf)
+		c.NewParamsBound = newParamsBound == 1
+
+		if c.NewParamsBound {
+			c.ParamTypes = make([]StmtParamType, numParams)
+			for i := 0; i < numParams; i++ {
+				typ := readInt1(buf)
+				unsignedFlag := readInt1(buf)
+				c.ParamTypes[i] = StmtParamType{Type: typ, Unsigned: unsignedFlag&0x80 != 0}
+			}
+		}
+
+		types := c.ParamTypes
+		if !c.NewParamsBound {
+			types = prevTypes
+		}
+
+		c.Params = make([][]byte, numParams)
+		for i := 0; i < numParams; i++ {
+			if isParamNull(c.NullBitmap, i) {
+				continue
+			}
+			p, err := readBinaryParam(buf, types, i)
+			if err != nil {
+				return c, err
+			}
+			c.Params[i] = p
+		}
+	}
+
+	return c, nil
+}
+
+func isParamNull(bitmap []byte, paramIndex int) bool {
+	byteIdx := paramIndex / 8
+	bitIdx := uint(paramIndex % 8)
+	return bitmap[byteIdx]&(1<<bitIdx) != 0
+}
+
+// readBinaryParam reads one value encoded in the COM_STMT_EXECUTE binary
+// param format. Fixed-width numeric/float types are read directly; strings,
+// blobs and decimals are length-encoded; the DATE/TIME/DATETIME/TIMESTAMP
+// family is its own packed struct (a 1-byte length followed by
+// year/month/day[/hour/min/sec[/microsecond]] for the date types, or
+// is_negative/days/hour/min/sec[/microsecond] for TIME) that happens to share the
+// length-encoded-integer prefix's small-value encoding, so it's read the
+// same way and left for the caller to interpret.
+// https://dev.mysql.com/doc/internals/en/binary-protocol-value.html
+func readBinaryParam(buf *bytes.Buffer, types []StmtParamType, i int) ([]byte, error) {
+	var typ uint8
+	if i < len(types) {
+		typ = types[i].Type
+	}
+
+	switch typ {
+	case MYSQL_TYPE_LONGLONG, MYSQL_TYPE_DOUBLE:
+		b := make([]byte, 8)
+		if n, _ := buf.Read(b); n != 8 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return b, nil
+	case MYSQL_TYPE_LONG, MYSQL_TYPE_INT24, MYSQL_TYPE_FLOAT:
+		b := make([]byte, 4)
+		if n, _ := buf.Read(b); n != 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return b, nil
+	case MYSQL_TYPE_SHORT, MYSQL_TYPE_YEAR:
+		b := make([]byte, 2)
+		if n, _ := buf.Read(b); n != 2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return b, nil
+	case MYSQL_TYPE_TINY:
+		b := make([]byte, 1)
+		if n, _ := buf.Read(b); n != 1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return b, nil
+	case MYSQL_TYPE_DATE, MYSQL_TYPE_TIME, MYSQL_TYPE_TIME2,
+		MYSQL_TYPE_DATETIME, MYSQL_TYPE_DATETIME2,
+		MYSQL_TYPE_TIMESTAMP, MYSQL_TYPE_TIMESTAMP2:
+		size, err := readIntVarE(buf)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size)
+		if n, _ := buf.Read(b); uint64(n) != size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return b, nil
+	default:
+		// STRING, VAR_STRING, BLOB, DECIMAL, NEWDECIMAL, etc. are all
+		// length-encoded on the wire.
+		size, err := readIntVarE(buf)
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size)
+		if n, _ := buf.Read(b); uint64(n) != size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return b, nil
+	}
+}
+
+// COM_REGISTER_SLAVE: https://dev.mysql.com/doc/internals/en/com-register-slave.html
+type ComRegisterSlave struct {
+	Command         Int1
+	ServerId        Int4
+	Hostname        StringLenEnc
+	User            StringLenEnc
+	Password        StringLenEnc
+	Port            Int2
+	ReplicationRank Int4
+	MasterId        Int4
+}
+
+// COM_BINLOG_DUMP: https://dev.mysql.com/doc/internals/en/com-binlog-dump.html
+type ComBinlogDump struct {
+	Command        Int1
+	BinlogPos      Int4
+	Flags          Int2
+	ServerId       Int4
+	BinlogFilename StringEOF
+}
+
+// ComBinlogDumpGTID is the decoded form of COM_BINLOG_DUMP_GTID. Its
+// filename and gtid_set fields are each preceded by their own length field
+// rather than being NUL-terminated or running to the end of the packet, so
+// (like ComStmtExecute) it can't be produced by the generic Unmarshal
+// reflection path.
+// https://dev.mysql.com/doc/internals/en/com-binlog-dump-gtid.html
+type ComBinlogDumpGTID struct {
+	Command      Int1
+	Flags        Int2
+	ServerId     Int4
+	Filename     string
+	Position     Int8
+	GTIDSet      string
+}
+
+func unmarshalComBinlogDumpGTID(data []byte) (ComBinlogDumpGTID, error) {
+	var c ComBinlogDumpGTID
+	if len(data) < 11 {
+		return c, io.ErrUnexpectedEOF
+	}
+
+	buf := bytes.NewBuffer(data)
+	c.Command = Int1(readInt1(buf))
+	c.Flags = Int2(readInt2(buf))
+	c.ServerId = Int4(readInt4(buf))
+
+	filenameLen := readInt4(buf)
+	filename := make([]byte, filenameLen)
+	if n, _ := buf.Read(filename); uint32(n) != filenameLen {
+		return c, io.ErrUnexpectedEOF
+	}
+	c.Filename = string(filename)
+
+	c.Position = Int8(readInt8(buf))
+
+	dataLen := readInt4(buf)
+	gtidSet := make([]byte, dataLen)
+	if n, _ := buf.Read(gtidSet); uint32(n) != dataLen {
+		return c, io.ErrUnexpectedEOF
+	}
+	c.GTIDSet = string(gtidSet)
+
+	return c, nil
+}
+
+// UnmarshalCommand decodes a command packet. stmts is the connection's table
+// of live prepared statements, keyed by StatementId; it is consulted (and
+// mutated, for COM_STMT_* commands) because several commands can't be
+// decoded without knowing state from an earlier COM_STMT_PREPARE. An
+// unrecognized command byte is reported as an error rather than a panic,
+// since the caller runs per-connection with no recover() and a single
+// unhandled command must not bring down the whole server.
+func UnmarshalCommand(data []byte, stmts map[uint32]*PreparedStatement) (interface{}, error) {
 	cmd := uint8(data[0])
-	
+
 	switch cmd {
 	case COM_QUIT:
 		var c ComQuit
-		Unmarshal(data, &c)
-		return c
+		if err := Unmarshal(nil, data, &c); err != nil {
+			fmt.Println("Failed to decode ComQuit", err)
+			return nil, nil
+		}
+		return c, nil
 	case COM_INIT_DB:
 		var c ComInitDB
-		Unmarshal(data, &c)
-		return c
+		if err := Unmarshal(nil, data, &c); err != nil {
+			fmt.Println("Failed to decode ComInitDB", err)
+			return nil, nil
+		}
+		return c, nil
 	case COM_QUERY:
-		
+
 		var c ComQuery
-		Unmarshal(data, &c)
+		if err := Unmarshal(nil, data, &c); err != nil {
+			fmt.Println("Failed to decode ComQuery", err)
+			return nil, nil
+		}
 		fmt.Println("ComQuery", c)
-		return c
-	
+		return c, nil
+
 	case COM_FIELD_LIST:
 		var c ComFieldList
-		Unmarshal(data, &c)
+		if err := Unmarshal(nil, data, &c); err != nil {
+			fmt.Println("Failed to decode ComFieldList", err)
+			return nil, nil
+		}
 		fmt.Println("ComFieldList", c)
-		return c
+		return c, nil
+
+	case COM_STMT_PREPARE:
+		var c ComStmtPrepare
+		if err := Unmarshal(nil, data, &c); err != nil {
+			fmt.Println("Failed to decode ComStmtPrepare", err)
+			return nil, nil
+		}
+		fmt.Println("ComStmtPrepare", c)
+		return c, nil
+
+	case COM_STMT_EXECUTE:
+		// The statement id is the first field after the command byte.
+		stmtId := binary.LittleEndian.Uint32(data[1:5])
+		stmt, ok := stmts[stmtId]
+		if !ok {
+			fmt.Println("COM_STMT_EXECUTE for unknown statement", stmtId)
+			return nil, nil
+		}
+		c, err := unmarshalComStmtExecute(data, stmt.NumParams, stmt.ParamTypes)
+		if err != nil {
+			return nil, fmt.Errorf("mysql: malformed COM_STMT_EXECUTE: %w", err)
+		}
+		if c.NewParamsBound {
+			stmt.ParamTypes = c.ParamTypes
+		}
+		return c, nil
+
+	case COM_STMT_SEND_LONG_DATA:
+		var c ComStmtSendLongData
+		if err := Unmarshal(nil, data, &c); err != nil {
+			fmt.Println("Failed to decode ComStmtSendLongData", err)
+			return nil, nil
+		}
+		if stmt, ok := stmts[uint32(c.StatementId)]; ok {
+			if stmt.LongData == nil {
+				stmt.LongData = make(map[int][]byte)
+			}
+			stmt.LongData[int(c.ParamId)] = append(stmt.LongData[int(c.ParamId)], []byte(c.ParamData)...)
+		}
+		// No response packet is sent for COM_STMT_SEND_LONG_DATA, even on error.
+		return c, nil
+
+	case COM_STMT_CLOSE:
+		var c ComStmtClose
+		if err := Unmarshal(nil, data, &c); err != nil {
+			fmt.Println("Failed to decode ComStmtClose", err)
+			return nil, nil
+		}
+		delete(stmts, uint32(c.StatementId))
+		// No response packet is sent for COM_STMT_CLOSE.
+		return c, nil
+
+	case COM_STMT_RESET:
+		var c ComStmtReset
+		if err := Unmarshal(nil, data, &c); err != nil {
+			fmt.Println("Failed to decode ComStmtReset", err)
+			return nil, nil
+		}
+		if stmt, ok := stmts[uint32(c.StatementId)]; ok {
+			stmt.LongData = nil
+		}
+		return c, nil
+
+	case COM_STMT_FETCH:
+		var c ComStmtFetch
+		if err := Unmarshal(nil, data, &c); err != nil {
+			fmt.Println("Failed to decode ComStmtFetch", err)
+			return nil, nil
+		}
+		return c, nil
+
+	case COM_REGISTER_SLAVE:
+		var c ComRegisterSlave
+		if err := Unmarshal(nil, data, &c); err != nil {
+			fmt.Println("Failed to decode ComRegisterSlave", err)
+			return nil, nil
+		}
+		fmt.Println("ComRegisterSlave", c)
+		return c, nil
+
+	case COM_BINLOG_DUMP:
+		var c ComBinlogDump
+		if err := Unmarshal(nil, data, &c); err != nil {
+			fmt.Println("Failed to decode ComBinlogDump", err)
+			return nil, nil
+		}
+		fmt.Println("ComBinlogDump", c)
+		return c, nil
+
+	case COM_BINLOG_DUMP_GTID:
+		c, err := unmarshalComBinlogDumpGTID(data)
+		if err != nil {
+			fmt.Println("Failed to decode COM_BINLOG_DUMP_GTID", err)
+			return nil, nil
+		}
+		fmt.Println("ComBinlogDumpGTID", c)
+		return c, nil
+
 	default:
-		fmt.Println("Got unknown command", cmd, "\n\n")
-		panic("Unknown command")
+		return nil, fmt.Errorf("mysql: unknown command 0x%02x", cmd)
 	}
 
-	return nil
+	return nil, nil
 }
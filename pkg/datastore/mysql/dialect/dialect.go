@@ -0,0 +1,372 @@
+// Package dialect translates queries and result metadata between the
+// MySQL dialect a client speaks and whatever dialect the server's actual
+// backend expects. It replaces the handful of hardcoded string-equality
+// rewrites that used to live directly in the connection handler.
+package dialect
+
+import (
+	"strings"
+)
+
+// Protocol::MYSQL_TYPE_* subset needed to answer RewriteColumnType. Kept
+// independent of pkg/datastore/mysql's own copy of these constants so this
+// package has no dependency on the wire-protocol package (and can be reused
+// by other frontends).
+const (
+	MySQLTypeLong       = 0x03
+	MySQLTypeDouble      = 0x05
+	MySQLTypeLongLong   = 0x08
+	MySQLTypeDate       = 0x0a
+	MySQLTypeDatetime   = 0x0c
+	MySQLTypeVarString  = 0xfd
+)
+
+// Rewriter translates a single query from the dialect a client speaks into
+// the dialect the backend expects, and maps a backend column type name
+// (e.g. what database/sql's ColumnType.DatabaseTypeName returns) back to the
+// MYSQL_TYPE_* the client should be told the column is. Implementations are
+// swappable per backend (Postgres, SQLite, CockroachDB-specific, ...).
+//
+// RewriteQuery returns the rewritten query text and any values that must be
+// bound as its positional parameters ($1, $2, ...), so that data pulled out
+// of the incoming query (e.g. a SHOW COLUMNS FROM table name) is always
+// passed to the backend as a bind parameter rather than concatenated into
+// the query text.
+type Rewriter interface {
+	RewriteQuery(query string) (string, []interface{})
+	RewriteColumnType(backendType string) uint8
+}
+
+// tokenKind categorizes one lexed piece of a query.
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota // identifier, keyword, or @@system_variable
+	tokenBacktickIdent
+	tokenString
+	tokenNumber
+	tokenPunct
+	tokenSpace
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// tokenize does a minimal lexical pass over a query: just enough to find
+// identifiers, backtick-quoted names, string literals, numbers and
+// punctuation without being tripped up by e.g. a keyword appearing inside a
+// quoted string. It does not need to understand SQL grammar beyond that.
+func tokenize(query string) []token {
+	var tokens []token
+	i := 0
+	n := len(query)
+
+	isWordStart := func(b byte) bool {
+		return b == '@' || b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+	}
+	isWordPart := func(b byte) bool {
+		return isWordStart(b) || (b >= '0' && b <= '9')
+	}
+
+	for i < n {
+		c := query[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			start := i
+			for i < n && (query[i] == ' ' || query[i] == '\t' || query[i] == '\n' || query[i] == '\r') {
+				i += 1
+			}
+			tokens = append(tokens, token{tokenSpace, query[start:i]})
+
+		case c == '`':
+			start := i
+			i += 1
+			for i < n && query[i] != '`' {
+				i += 1
+			}
+			if i < n {
+				i += 1 // consume closing backtick
+			}
+			tokens = append(tokens, token{tokenBacktickIdent, query[start:i]})
+
+		case c == '\'' || c == '"':
+			quote := c
+			start := i
+			i += 1
+			for i < n && query[i] != quote {
+				if query[i] == '\\' && i+1 < n {
+					i += 1
+				}
+				i += 1
+			}
+			if i < n {
+				i += 1
+			}
+			tokens = append(tokens, token{tokenString, query[start:i]})
+
+		case c >= '0' && c <= '9':
+			start := i
+			for i < n && (query[i] >= '0' && query[i] <= '9' || query[i] == '.') {
+				i += 1
+			}
+			tokens = append(tokens, token{tokenNumber, query[start:i]})
+
+		case isWordStart(c):
+			start := i
+			i += 1
+			for i < n && isWordPart(query[i]) {
+				i += 1
+			}
+			tokens = append(tokens, token{tokenWord, query[start:i]})
+
+		default:
+			tokens = append(tokens, token{tokenPunct, string(c)})
+			i += 1
+		}
+	}
+
+	return tokens
+}
+
+// PostgresRewriter implements Rewriter for a PostgreSQL (or CockroachDB,
+// which speaks the same wire dialect) backend.
+type PostgresRewriter struct{}
+
+var systemVariables = map[string]string{
+	"@@version":        "'8.0.0'",
+	"@@version_comment": "version()",
+	"@@sql_mode":        "''",
+	"@@tx_isolation":    "'REPEATABLE-READ'",
+	"@@session.tx_isolation": "'REPEATABLE-READ'",
+}
+
+func (PostgresRewriter) RewriteQuery(query string) (string, []interface{}) {
+	trimmed := strings.TrimSpace(query)
+	upper := strings.ToUpper(trimmed)
+
+	switch {
+	case upper == "SHOW TABLES":
+		return "SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema()", nil
+	case upper == "SHOW DATABASES":
+		return "SELECT datname FROM pg_database", nil
+	case strings.HasPrefix(upper, "SHOW COLUMNS FROM "):
+		table := strings.TrimSpace(query[len("SHOW COLUMNS FROM "):])
+		table = strings.Trim(table, "`")
+		return "SELECT column_name FROM information_schema.columns WHERE table_name = $1", []interface{}{table}
+	}
+
+	tokens := tokenize(query)
+	tokens = rewriteSystemVariables(tokens)
+	tokens = rewriteBacktickIdentifiers(tokens)
+	tokens = rewriteUnixTimestamp(tokens)
+	tokens = rewriteDatabaseFunction(tokens)
+	tokens = rewriteLimitOffset(tokens)
+	tokens = rewriteOnDuplicateKeyUpdate(tokens)
+
+	var out strings.Builder
+	for _, t := range tokens {
+		out.WriteString(t.text)
+	}
+	return out.String(), nil
+}
+
+func rewriteSystemVariables(tokens []token) []token {
+	var out []token
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.kind != tokenWord {
+			out = append(out, t)
+			continue
+		}
+
+		// A dotted reference like @@session.tx_isolation tokenizes as three
+		// separate tokens (the tokenizer doesn't treat '.' as a word
+		// character), so reconstruct the dotted name before looking it up.
+		name := t.text
+		last := i
+		if i+2 < len(tokens) && tokens[i+1].text == "." && tokens[i+2].kind == tokenWord {
+			name = t.text + "." + tokens[i+2].text
+			last = i + 2
+		}
+
+		if replacement, ok := systemVariables[strings.ToLower(name)]; ok {
+			out = append(out, token{tokenWord, replacement})
+			i = last
+			continue
+		}
+
+		out = append(out, t)
+	}
+	return out
+}
+
+// rewriteBacktickIdentifiers turns `ident` into "ident", since Postgres uses
+// double quotes for quoted identifiers.
+func rewriteBacktickIdentifiers(tokens []token) []token {
+	out := make([]token, len(tokens))
+	for i, t := range tokens {
+		if t.kind == tokenBacktickIdent {
+			inner := strings.Trim(t.text, "`")
+			out[i] = token{tokenBacktickIdent, "\"" + inner + "\""}
+		} else {
+			out[i] = t
+		}
+	}
+	return out
+}
+
+// rewriteUnixTimestamp turns UNIX_TIMESTAMP() into Postgres's equivalent.
+func rewriteUnixTimestamp(tokens []token) []token {
+	var out []token
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.kind == tokenWord && strings.EqualFold(t.text, "UNIX_TIMESTAMP") &&
+			i+2 < len(tokens) && tokens[i+1].text == "(" && tokens[i+2].text == ")" {
+			out = append(out, token{tokenWord, "EXTRACT(EPOCH FROM now())"})
+			i += 2
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// rewriteDatabaseFunction turns DATABASE() into Postgres's equivalent.
+// SELECT DATABASE() is one of the first queries many MySQL clients/ORMs
+// send right after connecting.
+func rewriteDatabaseFunction(tokens []token) []token {
+	var out []token
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if t.kind == tokenWord && strings.EqualFold(t.text, "DATABASE") &&
+			i+2 < len(tokens) && tokens[i+1].text == "(" && tokens[i+2].text == ")" {
+			out = append(out, token{tokenWord, "current_database()"})
+			i += 2
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// rewriteLimitOffset turns "LIMIT n, m" into "LIMIT m OFFSET n", since
+// Postgres doesn't support the two-argument comma form.
+func rewriteLimitOffset(tokens []token) []token {
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].kind != tokenWord || !strings.EqualFold(tokens[i].text, "LIMIT") {
+			continue
+		}
+
+		rest := tokens[i+1:]
+		nonSpace := func(from int) (int, token, bool) {
+			for j := from; j < len(rest); j++ {
+				if rest[j].kind != tokenSpace {
+					return j, rest[j], true
+				}
+			}
+			return 0, token{}, false
+		}
+
+		j1, offsetTok, ok1 := nonSpace(0)
+		if !ok1 || offsetTok.kind != tokenNumber {
+			continue
+		}
+		j2, commaTok, ok2 := nonSpace(j1 + 1)
+		if !ok2 || commaTok.text != "," {
+			continue
+		}
+		j3, countTok, ok3 := nonSpace(j2 + 1)
+		if !ok3 || countTok.kind != tokenNumber {
+			continue
+		}
+
+		replacement := []token{
+			{tokenWord, "LIMIT"},
+			{tokenSpace, " "},
+			{tokenNumber, countTok.text},
+			{tokenSpace, " "},
+			{tokenWord, "OFFSET"},
+			{tokenSpace, " "},
+			{tokenNumber, offsetTok.text},
+		}
+
+		newTokens := append([]token{}, tokens[:i]...)
+		newTokens = append(newTokens, replacement...)
+		newTokens = append(newTokens, rest[j3+1:]...)
+		return rewriteLimitOffset(newTokens) // handle any further LIMITs
+	}
+	return tokens
+}
+
+// rewriteOnDuplicateKeyUpdate turns "ON DUPLICATE KEY UPDATE col = val, ..."
+// into Postgres's "ON CONFLICT (id) DO UPDATE SET col = val, ...". Postgres
+// requires an explicit conflict target column list for "DO UPDATE", so this
+// assumes the common convention of a primary key column named "id"; a table
+// with a different or compound key needs its conflict target rewritten by
+// hand.
+func rewriteOnDuplicateKeyUpdate(tokens []token) []token {
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].kind != tokenWord || !strings.EqualFold(tokens[i].text, "ON") {
+			continue
+		}
+
+		j, dup, ok := nextWord(tokens, i+1)
+		if !ok || !strings.EqualFold(dup.text, "DUPLICATE") {
+			continue
+		}
+		j, key, ok := nextWord(tokens, j+1)
+		if !ok || !strings.EqualFold(key.text, "KEY") {
+			continue
+		}
+		j, update, ok := nextWord(tokens, j+1)
+		if !ok || !strings.EqualFold(update.text, "UPDATE") {
+			continue
+		}
+
+		replacement := []token{
+			{tokenWord, "ON CONFLICT (id) DO UPDATE SET"},
+		}
+		newTokens := append([]token{}, tokens[:i]...)
+		newTokens = append(newTokens, replacement...)
+		newTokens = append(newTokens, tokens[j+1:]...)
+		return newTokens
+	}
+	return tokens
+}
+
+// nextWord skips tokenSpace tokens starting at i and returns the index and
+// value of the first non-space token found, so callers can chain matches
+// without losing track of where the previous match ended.
+func nextWord(tokens []token, i int) (int, token, bool) {
+	for ; i < len(tokens); i++ {
+		if tokens[i].kind != tokenSpace {
+			return i, tokens[i], true
+		}
+	}
+	return 0, token{}, false
+}
+
+func (PostgresRewriter) RewriteColumnType(backendType string) uint8 {
+	switch strings.ToUpper(backendType) {
+	case "INT2", "INT4", "SERIAL":
+		return MySQLTypeLong
+	case "INT8", "BIGSERIAL":
+		return MySQLTypeLongLong
+	case "FLOAT4", "FLOAT8", "NUMERIC":
+		return MySQLTypeDouble
+	case "DATE":
+		return MySQLTypeDate
+	case "TIMESTAMP", "TIMESTAMPTZ":
+		return MySQLTypeDatetime
+	default:
+		return MySQLTypeVarString
+	}
+}
+
+// Default is the rewriter used when the server hasn't been configured with
+// a more specific one; today that's always Postgres, the only backend this
+// server supports.
+var Default Rewriter = PostgresRewriter{}
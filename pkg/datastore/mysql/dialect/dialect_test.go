@@ -0,0 +1,31 @@
+package dialect
+
+import "testing"
+
+// TestRewriteQueryShowColumnsParameterizesTableName guards against the
+// table name being concatenated straight into the rewritten SQL text: a
+// table name containing a quote must come back as a bind argument, never
+// as part of the query string itself.
+func TestRewriteQueryShowColumnsParameterizesTableName(t *testing.T) {
+	query, args := PostgresRewriter{}.RewriteQuery(`SHOW COLUMNS FROM x' OR '1'='1`)
+
+	wantQuery := "SELECT column_name FROM information_schema.columns WHERE table_name = $1"
+	if query != wantQuery {
+		t.Errorf("query = %q, want %q", query, wantQuery)
+	}
+	if len(args) != 1 || args[0] != `x' OR '1'='1` {
+		t.Errorf("args = %v, want [%q]", args, `x' OR '1'='1`)
+	}
+}
+
+func TestRewriteQueryDatabaseFunction(t *testing.T) {
+	query, args := PostgresRewriter{}.RewriteQuery("SELECT DATABASE()")
+
+	want := "SELECT current_database()"
+	if query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+	if args != nil {
+		t.Errorf("args = %v, want nil", args)
+	}
+}
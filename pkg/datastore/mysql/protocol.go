@@ -1,4 +1,4 @@
-package main
+package mysql
 
 // NOTE: Throughout this, we assume Protocol 41
 
@@ -7,7 +7,10 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"io"
 	"reflect"
+	"strconv"
+	"strings"
 )
 
 // https://dev.mysql.com/doc/internals/en/integer.html
@@ -26,8 +29,32 @@ type StringVar string
 type StringLenEnc string
 type StringEOF string
 
+// CodecCtx carries the capability flags negotiated for a connection, so that
+// Marshal/Unmarshal can decide whether an `if=` tagged field is present on
+// the wire. A nil *CodecCtx behaves as if no capabilities are set, which is
+// the right answer for every packet type that has no conditional fields.
+type CodecCtx struct {
+	Capabilities uint32
+}
 
+// capabilityFlagsByName mirrors the subset of the CLIENT_* capability flags
+// (defined in pkg/mysql, which imports this package and so can't be imported
+// back without a cycle) that appear in an `if=` struct tag below. Like
+// dialect.go's own copy of the MYSQL_TYPE_* constants, this is kept
+// independent on purpose.
+var capabilityFlagsByName = map[string]uint32{
+	"CLIENT_CONNECT_WITH_DB":                0x00000008,
+	"CLIENT_SECURE_CONNECTION":              0x00008000,
+	"CLIENT_PLUGIN_AUTH":                    0x00080000,
+	"CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA": 0x00200000,
+}
 
+func (c *CodecCtx) hasCapability(name string) bool {
+	if c == nil {
+		return false
+	}
+	return c.Capabilities&capabilityFlagsByName[name] != 0
+}
 
 func readInt1(buf *bytes.Buffer) (v uint8) {
 	b, _ := buf.ReadByte()
@@ -100,23 +127,6 @@ func writeInt8(buf *bytes.Buffer, v uint64) {
 	return
 }
 
-func readIntVar(buf *bytes.Buffer) uint64 {
-	var i uint64 = 0
-	b, _ := buf.ReadByte()
-	if b < 0xfb {
-		i = uint64(b)
-	} else if b == 0xfc {
-		i = uint64(readInt2(buf))
-	} else if b == 0xfd {
-		i = uint64(readInt3(buf))
-	} else if b == 0xfe {
-		i = readInt8(buf)
-	} else {
-		panic("Unknown var int")
-	}
-	
-	return i;
-}
 func writeIntVar(buf *bytes.Buffer, v uint64) {
 	if v < 0xfb {
 		buf.WriteByte(byte(v))
@@ -132,30 +142,192 @@ func writeIntVar(buf *bytes.Buffer, v uint64) {
 	}
 }
 
+// readIntVarE decodes a length-encoded integer (the inverse of writeIntVar),
+// returning an error so that Unmarshal reports a truncated length-encoded
+// integer instead of silently reading zeros.
+func readIntVarE(buf *bytes.Buffer) (uint64, error) {
+	b, err := buf.ReadByte()
+	if err != nil {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	switch {
+	case b < 0xfb:
+		return uint64(b), nil
+	case b == 0xfc:
+		if err := requireLen(buf, 2); err != nil {
+			return 0, err
+		}
+		return uint64(readInt2(buf)), nil
+	case b == 0xfd:
+		if err := requireLen(buf, 3); err != nil {
+			return 0, err
+		}
+		return uint64(readInt3(buf)), nil
+	case b == 0xfe:
+		if err := requireLen(buf, 8); err != nil {
+			return 0, err
+		}
+		return readInt8(buf), nil
+	default:
+		return 0, fmt.Errorf("mysql: invalid length-encoded integer prefix 0x%x", b)
+	}
+}
+
 func readStringNul(buf *bytes.Buffer) string {
 	str, _ := buf.ReadString(byte(0))
 	str = str[0:len(str) - 1]
 	return string(str)
 }
 
+// readStringNulE is the error-returning counterpart of readStringNul, used
+// by Unmarshal so a missing NUL terminator is reported instead of silently
+// consuming the rest of the buffer.
+func readStringNulE(buf *bytes.Buffer) (string, error) {
+	str, err := buf.ReadString(0)
+	if err != nil {
+		return "", io.ErrUnexpectedEOF
+	}
+	return str[:len(str)-1], nil
+}
+
 func readStringVar(buf *bytes.Buffer, size uint) string {
 	b := make([]byte, size)
 	buf.Read(b)
 	return string(b)
 }
 
+// requireLen fails with io.ErrUnexpectedEOF if buf doesn't have at least n
+// bytes left, so Unmarshal can report a truncated packet instead of reading
+// past what the client actually sent.
+func requireLen(buf *bytes.Buffer, n int) error {
+	if buf.Len() < n {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// fieldTag is the parsed form of a field's `mysql:"..."` struct tag. A tag
+// is a comma-separated list of directives:
+//
+//   if=CAPABILITY_NAME       field is only present when that capability flag
+//                            (looked up in capabilityFlagsByName) is set
+//   len=N                    field is exactly N bytes
+//   lenfrom=Field,min=M,sub=S  field length is MAX(min, Field's value - sub);
+//                            Field must be an earlier field in the struct
+//   eof                      field consumes the rest of the payload, even if
+//                            it isn't the struct's last field
+type fieldTag struct {
+	ifFlag  string
+	hasLen  bool
+	len     int
+	lenFrom string
+	hasMin  bool
+	min     int
+	hasSub  bool
+	sub     int
+	eof     bool
+}
 
+func parseFieldTag(tag string) (fieldTag, error) {
+	var t fieldTag
+	if tag == "" {
+		return t, nil
+	}
 
-// TODO: Also return an error
-func Marshal(v interface{}) []byte {
+	for _, part := range strings.Split(tag, ",") {
+		if part == "eof" {
+			t.eof = true
+			continue
+		}
+
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return t, fmt.Errorf("mysql: malformed struct tag directive %q", part)
+		}
+		key, value := kv[0], kv[1]
+
+		switch key {
+		case "if":
+			t.ifFlag = value
+		case "len":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return t, fmt.Errorf("mysql: invalid len in struct tag: %v", err)
+			}
+			t.hasLen = true
+			t.len = n
+		case "lenfrom":
+			t.lenFrom = value
+		case "min":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return t, fmt.Errorf("mysql: invalid min in struct tag: %v", err)
+			}
+			t.hasMin = true
+			t.min = n
+		case "sub":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return t, fmt.Errorf("mysql: invalid sub in struct tag: %v", err)
+			}
+			t.hasSub = true
+			t.sub = n
+		default:
+			return t, fmt.Errorf("mysql: unknown struct tag directive %q", key)
+		}
+	}
+
+	return t, nil
+}
+
+// resolveLength works out how many bytes a StringFix/StringVar field occupies
+// from its parsed tag, consulting an already-decoded sibling field (val) for
+// the `lenfrom` case.
+func resolveLength(tag fieldTag, val reflect.Value) (int, error) {
+	if tag.hasLen {
+		return tag.len, nil
+	}
+
+	if tag.lenFrom != "" {
+		src := val.FieldByName(tag.lenFrom)
+		if !src.IsValid() {
+			return 0, fmt.Errorf("mysql: lenfrom field %q not found", tag.lenFrom)
+		}
+
+		n := int(src.Uint())
+		if tag.hasSub {
+			n -= tag.sub
+		}
+		if tag.hasMin && n < tag.min {
+			n = tag.min
+		}
+		return n, nil
+	}
+
+	return 0, fmt.Errorf("mysql: field has neither a len nor a lenfrom struct tag")
+}
+
+// Marshal encodes v (a pointer to a packet struct) into its wire
+// representation. ctx supplies the capability flags that decide whether an
+// `if=`-tagged field is written; pass nil for packets with no such fields.
+func Marshal(ctx *CodecCtx, v interface{}) ([]byte, error) {
 	typ := reflect.TypeOf(v).Elem()
 	val := reflect.ValueOf(v).Elem()
-	
+
 	var buf bytes.Buffer
-	
+
 	for i := 0; i < val.NumField(); i++ {
 		f := val.Field(i)
-				
+
+		tag, err := parseFieldTag(typ.Field(i).Tag.Get("mysql"))
+		if err != nil {
+			return nil, err
+		}
+		if tag.ifFlag != "" && !ctx.hasCapability(tag.ifFlag) {
+			continue
+		}
+
 		switch f.Interface().(type) {
 			case Int1:
 				writeInt1(&buf, uint8(f.Uint()))
@@ -172,105 +344,156 @@ func Marshal(v interface{}) []byte {
 			case IntVar:
 				writeIntVar(&buf, uint64(f.Uint()))
 			case StringFix:
-
-				var size int
-				fmt.Sscanf(typ.Field(i).Tag.Get("mysql"), "len=%d", &size)
-
-				if len(f.String()) != size {
-					fmt.Println("Fixed length string wrong length", len(f.String()), "!=", size)
+				if tag.hasLen || tag.lenFrom != "" {
+					size, err := resolveLength(tag, val)
+					if err != nil {
+						return nil, err
+					}
+					if len(f.String()) != size {
+						return nil, fmt.Errorf("mysql: field %s: fixed length string has wrong length (%d != %d)", typ.Field(i).Name, len(f.String()), size)
+					}
 				}
-				
+
 				buf.WriteString(f.String())
-				
+
 			case StringVar:
 				buf.WriteString(f.String())
-				
+
 			case StringNUL:
 				buf.WriteString(f.String() + "\x00")
 			case StringLenEnc:
 				writeIntVar(&buf, uint64(len(f.String())))
 				buf.WriteString(f.String())
 			case StringEOF:
-				if i != val.NumField() - 1 {
-					panic("StringEOF not at end of struct")
+				if !tag.eof && i != val.NumField() - 1 {
+					return nil, fmt.Errorf("mysql: field %s: StringEOF must be the last field in the struct", typ.Field(i).Name)
 				}
 				buf.WriteString(f.String())
 			default:
-				fmt.Println(i, f.Kind(), f.Type())
-				panic("Unknown protocol basic type while marshaling")
+				return nil, fmt.Errorf("mysql: field %s: unsupported protocol type %s", typ.Field(i).Name, f.Type())
 		}
 	}
-	
-	return buf.Bytes()
+
+	return buf.Bytes(), nil
 }
 
-// TODO: Would it be more efficient to pass in a pointer to the bytes?
-func Unmarshal(data []byte, v interface{}) {
-	typ := reflect.TypeOf(v).Elem() 
+// Unmarshal decodes data (a packet payload) into v (a pointer to a packet
+// struct). ctx supplies the capability flags that decide whether an
+// `if=`-tagged field is present; pass nil for packets with no such fields,
+// or (for a packet like HandshakeResponse whose own capability flags decide
+// its later fields) build one from the flags read out of data beforehand.
+func Unmarshal(ctx *CodecCtx, data []byte, v interface{}) error {
+	typ := reflect.TypeOf(v).Elem()
 	val := reflect.ValueOf(v).Elem()
-	
-	buf := bytes.NewBuffer(data)	
-	
+
+	buf := bytes.NewBuffer(data)
+
 	for i := 0; i < val.NumField(); i++ {
 		f := val.Field(i)
-		
+
+		tag, err := parseFieldTag(typ.Field(i).Tag.Get("mysql"))
+		if err != nil {
+			return err
+		}
+		if tag.ifFlag != "" && !ctx.hasCapability(tag.ifFlag) {
+			continue
+		}
+
 		switch f.Interface().(type) {
 			case Int1:
-				i := readInt1(buf)
-				f.SetUint(uint64(i))
+				if err := requireLen(buf, 1); err != nil {
+					return err
+				}
+				f.SetUint(uint64(readInt1(buf)))
 			case Int2:
-				i := readInt2(buf)
-				f.SetUint(uint64(i))
-			case Int3:	
-				i := readInt3(buf)
-				f.SetUint(uint64(i))
+				if err := requireLen(buf, 2); err != nil {
+					return err
+				}
+				f.SetUint(uint64(readInt2(buf)))
+			case Int3:
+				if err := requireLen(buf, 3); err != nil {
+					return err
+				}
+				f.SetUint(uint64(readInt3(buf)))
 			case Int4:
-				i := readInt4(buf)
-				f.SetUint(uint64(i))
+				if err := requireLen(buf, 4); err != nil {
+					return err
+				}
+				f.SetUint(uint64(readInt4(buf)))
 			case Int6:
-				i := readInt6(buf)
-				f.SetUint(uint64(i))
+				if err := requireLen(buf, 6); err != nil {
+					return err
+				}
+				f.SetUint(uint64(readInt6(buf)))
 			case Int8:
-				i := readInt8(buf)
-				f.SetUint(uint64(i))
+				if err := requireLen(buf, 8); err != nil {
+					return err
+				}
+				f.SetUint(readInt8(buf))
 			case IntVar:
-				i := readIntVar(buf)
-				f.SetUint(uint64(i))
-				
+				n, err := readIntVarE(buf)
+				if err != nil {
+					return err
+				}
+				f.SetUint(n)
+
 			case StringFix:
-				var size uint
-				fmt.Sscanf(typ.Field(i).Tag.Get("mysql"), "len=%d", &size)
+				size, err := resolveLength(tag, val)
+				if err != nil {
+					return err
+				}
+				if err := requireLen(buf, size); err != nil {
+					return err
+				}
 				b := make([]byte, size)
 				buf.Read(b)
 				f.SetString(string(b))
 			case StringNUL:
-				str := readStringNul(buf)
+				str, err := readStringNulE(buf)
+				if err != nil {
+					return err
+				}
 				f.SetString(str)
-			// case StringVar
-				
+			case StringVar:
+				size, err := resolveLength(tag, val)
+				if err != nil {
+					return err
+				}
+				if err := requireLen(buf, size); err != nil {
+					return err
+				}
+				b := make([]byte, size)
+				buf.Read(b)
+				f.SetString(string(b))
 			case StringLenEnc:
-				size := readIntVar(buf)
+				size, err := readIntVarE(buf)
+				if err != nil {
+					return err
+				}
+				if err := requireLen(buf, int(size)); err != nil {
+					return err
+				}
 				b := make([]byte, size)
 				buf.Read(b)
 				f.SetString(string(b))
 			case StringEOF:
+				if !tag.eof && i != val.NumField() - 1 {
+					return fmt.Errorf("mysql: field %s: StringEOF must be the last field in the struct", typ.Field(i).Name)
+				}
 				b := make([]byte, buf.Len())
 				buf.Read(b)
 				f.SetString(string(b))
-			
 			default:
-				fmt.Println(i, f.Kind(), f.Type())
-				panic("Unknown protocol basic type while unmarshaling")
-
-
+				return fmt.Errorf("mysql: field %s: unsupported protocol type %s", typ.Field(i).Name, f.Type())
 		}
 	}
-	
-} 
+
+	return nil
+}
 
 func UnmarshalPacket(data []byte, v *Packet) {
 	buf := bytes.NewBuffer(data)
-	
+
 	v.PayloadLength = Int3(readInt3(buf))
 	v.SequenceId = Int1(readInt1(buf))
 	v.Payload = StringVar(readStringVar(buf, uint(v.PayloadLength)))
@@ -287,7 +510,6 @@ type Packet struct {
 
 
 // HandshakeV10: https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::Handshake
-// TODO: There are also some other optional fields in this
 type Handshake struct {
 	ProtocolVersion Int1
 	ServerVersion StringNUL
@@ -295,16 +517,16 @@ type Handshake struct {
 	AuthPluginDataPart1 StringFix `mysql:"len=8"`
 	Filler1 Int1
 	CapabilityFlag1 Int2
-	// Optional below here	
+	// Optional below here
 	CharacterSet Int1
 	StatusFlags Int2
 	CapabilityFlags2 Int2
 	AuthPluginDataLen Int1
-	Reserved StringFix `mysql:"len=10"` // all zero 
-	
-	AuthPluginDataPart2 StringVar `mysql:CLIENT_SECURE_CONNECTION` // if capabilities & CLIENT_SECURE_CONNECTION
-	//^ string[$len]   auth-plugin-data-part-2 ($len=MAX(13, length of auth-plugin-data - 8))
-	AuthPluginName StringNUL `mysql:CLIENT_PLUGIN_AUTH` // if capabilities & CLIENT_PLUGIN_AUTH
+	Reserved StringFix `mysql:"len=10"` // all zero
+
+	// string[$len]   auth-plugin-data-part-2 ($len=MAX(13, length of auth-plugin-data - 8))
+	AuthPluginDataPart2 StringVar `mysql:"if=CLIENT_SECURE_CONNECTION,lenfrom=AuthPluginDataLen,min=13,sub=8"`
+	AuthPluginName StringNUL `mysql:"if=CLIENT_PLUGIN_AUTH"`
 }
 
 // HandshakeResponse41: https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::HandshakeResponse
@@ -314,10 +536,13 @@ type HandshakeResponse struct {
 	CharacterSet Int1
 	Reserved StringFix `mysql:"len=23"` // All zero
 	Username StringNUL
-	AuthResponse StringLenEnc // if capabilities & CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA  (TODO: There are two other alternatives to this)
-	
-	Database StringNUL // if capabilities & CLIENT_CONNECT_WITH_DB
-	AuthPluginName StringNUL // if capabilities & CLIENT_PLUGIN_AUTH
+
+	// TODO: There are two other (non-lenenc) wire forms this field can take
+	// when CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA isn't set.
+	AuthResponse StringLenEnc `mysql:"if=CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA"`
+
+	Database StringNUL `mysql:"if=CLIENT_CONNECT_WITH_DB"`
+	AuthPluginName StringNUL `mysql:"if=CLIENT_PLUGIN_AUTH"`
 	// ... More stuff we don't really care about
 }
 
@@ -346,23 +571,3 @@ type ERRPacket struct { // ERR_Packet
 	SqlState StringFix `mysql:"len=5"`
 	ErrorMessage StringEOF
 }
-
-/*
-func UnmarshalHandshakeResponse(data []byte, v *HandshakeResponse) {
-	buf := bytes.NewBuffer(data)
-	
-	v.CapabilityFlag = readInt4(buf)
-	v.MaxPacketSize = readInt4(buf)
-	v.Reserved = readStringVar(buf, 23)
-	v.Username = readStringNul(buf)
-	
-	if v.CapabilityFlag & CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA {
-		v.AuthResponse = 
-	}
-	
-	if v.CapabilityFlag & CLIENT_CONNECT_WITH_DB {
-		v.Database = 
-	}
-
-}
-*/
@@ -0,0 +1,314 @@
+package mysql
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// The byte sequences below are hand-constructed payloads, built the same
+// way Marshal/Unmarshal build and consume a packet (command byte followed
+// by its fields), not captured from a real client session.
+
+func TestMarshalOKPacket(t *testing.T) {
+	pkt := &OKPacket{
+		Header:       0x00,
+		AffectedRows: 1,
+		LastInsertId: 0,
+		StatusFlags:  2,
+		Warnings:     0,
+		Info:         "",
+	}
+	want := []byte{0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00}
+
+	got, err := Marshal(nil, pkt)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Marshal(OKPacket) = % x, want % x", got, want)
+	}
+}
+
+func TestMarshalEOFPacket(t *testing.T) {
+	pkt := &EOFPacket{Header: 0xfe, Warnings: 0, StatusFlags: 2}
+	want := []byte{0xfe, 0x00, 0x00, 0x02, 0x00}
+
+	got, err := Marshal(nil, pkt)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Marshal(EOFPacket) = % x, want % x", got, want)
+	}
+}
+
+func TestMarshalERRPacket(t *testing.T) {
+	pkt := &ERRPacket{
+		Header:         0xff,
+		ErrorCode:      1045,
+		SqlStateMarker: "#",
+		SqlState:       "28000",
+		ErrorMessage:   "Access denied",
+	}
+	want := append(
+		[]byte{0xff, 0x15, 0x04, '#', '2', '8', '0', '0', '0'},
+		"Access denied"...,
+	)
+
+	got, err := Marshal(nil, pkt)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Marshal(ERRPacket) = % x, want % x", got, want)
+	}
+}
+
+func TestUnmarshalComQuery(t *testing.T) {
+	data := append([]byte{0x03}, "SELECT 1"...)
+
+	var c ComQuery
+	if err := Unmarshal(nil, data, &c); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if c.Command != 0x03 || string(c.Query) != "SELECT 1" {
+		t.Errorf("Unmarshal(ComQuery) = %+v", c)
+	}
+}
+
+func TestUnmarshalComStmtClose(t *testing.T) {
+	data := []byte{0x19, 0x01, 0x00, 0x00, 0x00}
+
+	var c ComStmtClose
+	if err := Unmarshal(nil, data, &c); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if c.Command != 0x19 || c.StatementId != 1 {
+		t.Errorf("Unmarshal(ComStmtClose) = %+v", c)
+	}
+}
+
+// TestUnmarshalHandshakeResponseWithoutOptionalFields covers the case where
+// none of the `if=` tagged fields' capability flags are set: Database and
+// AuthPluginName should be left zero-valued and not consume any bytes.
+func TestUnmarshalHandshakeResponseWithoutOptionalFields(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0x00, 0x00, 0x00, 0x00}) // CapabilityFlag: none set
+	buf.Write([]byte{0x00, 0x00, 0x00, 0x00}) // MaxPacketSize
+	buf.WriteByte(33)                         // CharacterSet
+	buf.Write(make([]byte, 23))               // Reserved
+	buf.WriteString("root\x00")                // Username
+
+	ctx := &CodecCtx{Capabilities: 0}
+
+	var resp HandshakeResponse
+	if err := Unmarshal(ctx, buf.Bytes(), &resp); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if string(resp.Username) != "root" {
+		t.Errorf("Username = %q, want %q", resp.Username, "root")
+	}
+	if resp.Database != "" || resp.AuthPluginName != "" {
+		t.Errorf("optional fields should be empty when their capability flag is unset, got Database=%q AuthPluginName=%q", resp.Database, resp.AuthPluginName)
+	}
+}
+
+// TestUnmarshalHandshakeResponseWithOptionalFields covers the case where
+// CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA, CLIENT_CONNECT_WITH_DB and
+// CLIENT_PLUGIN_AUTH are all set, so AuthResponse/Database/AuthPluginName
+// should all be decoded.
+func TestUnmarshalHandshakeResponseWithOptionalFields(t *testing.T) {
+	var buf bytes.Buffer
+	caps := uint32(0x00200000 | 0x00000008 | 0x00080000)
+	writeInt4(&buf, caps)
+	buf.Write([]byte{0x00, 0x00, 0x00, 0x00}) // MaxPacketSize
+	buf.WriteByte(33)                         // CharacterSet
+	buf.Write(make([]byte, 23))               // Reserved
+	buf.WriteString("root\x00")                // Username
+	buf.WriteByte(20)                          // AuthResponse length-encoded prefix
+	buf.Write(bytes.Repeat([]byte{0xab}, 20))  // AuthResponse
+	buf.WriteString("wordpress\x00")            // Database
+	buf.WriteString("caching_sha2_password\x00") // AuthPluginName
+
+	ctx := &CodecCtx{Capabilities: caps}
+
+	var resp HandshakeResponse
+	if err := Unmarshal(ctx, buf.Bytes(), &resp); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(resp.AuthResponse) != 20 {
+		t.Errorf("AuthResponse length = %d, want 20", len(resp.AuthResponse))
+	}
+	if resp.Database != "wordpress" {
+		t.Errorf("Database = %q, want %q", resp.Database, "wordpress")
+	}
+	if resp.AuthPluginName != "caching_sha2_password" {
+		t.Errorf("AuthPluginName = %q, want %q", resp.AuthPluginName, "caching_sha2_password")
+	}
+}
+
+// TestMarshalHandshakeConditionalFields covers the Handshake packet's
+// lenfrom/min/sub-governed AuthPluginDataPart2 field and its if=-governed
+// AuthPluginName field.
+func TestMarshalHandshakeConditionalFields(t *testing.T) {
+	scramble := bytes.Repeat([]byte{0x11}, 20)
+
+	ctx := &CodecCtx{Capabilities: 0x00008000 | 0x00080000} // CLIENT_SECURE_CONNECTION | CLIENT_PLUGIN_AUTH
+
+	pkt := &Handshake{
+		ProtocolVersion:     10,
+		ServerVersion:       "5.7.19",
+		ConnectionId:        1,
+		AuthPluginDataPart1: StringFix(scramble[0:8]),
+		Filler1:             0,
+		CapabilityFlag1:     0,
+		CharacterSet:        33,
+		StatusFlags:         2,
+		CapabilityFlags2:    0,
+		AuthPluginDataLen:   21,
+		Reserved:            "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		AuthPluginDataPart2: StringVar(string(scramble[8:20]) + "\x00"),
+		AuthPluginName:      "caching_sha2_password",
+	}
+
+	got, err := Marshal(ctx, pkt)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var want bytes.Buffer
+	want.WriteByte(10)
+	want.WriteString("5.7.19\x00")
+	writeInt4(&want, 1)
+	want.Write(scramble[0:8])
+	want.WriteByte(0)
+	writeInt2(&want, 0)
+	want.WriteByte(33)
+	writeInt2(&want, 2)
+	writeInt2(&want, 0)
+	want.WriteByte(21)
+	want.Write(make([]byte, 10))
+	want.Write(scramble[8:20])
+	want.WriteByte(0)
+	want.WriteString("caching_sha2_password\x00")
+
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("Marshal(Handshake) =\n% x\nwant\n% x", got, want.Bytes())
+	}
+}
+
+// TestUnmarshalHandshakeLenFrom exercises the lenfrom=AuthPluginDataLen,
+// min=13,sub=8 rule that sizes AuthPluginDataPart2: with AuthPluginDataLen
+// set to 21, its length should come out to MAX(13, 21-8) = 13.
+func TestUnmarshalHandshakeLenFrom(t *testing.T) {
+	scramble := bytes.Repeat([]byte{0x22}, 20)
+
+	var buf bytes.Buffer
+	buf.WriteByte(10)
+	buf.WriteString("5.7.19\x00")
+	writeInt4(&buf, 1)
+	buf.Write(scramble[0:8])
+	buf.WriteByte(0)
+	writeInt2(&buf, 0)
+	buf.WriteByte(33)
+	writeInt2(&buf, 2)
+	writeInt2(&buf, 0)
+	buf.WriteByte(21) // AuthPluginDataLen
+	buf.Write(make([]byte, 10))
+	buf.Write(scramble[8:20])
+	buf.WriteByte(0)
+	buf.WriteString("caching_sha2_password\x00")
+
+	ctx := &CodecCtx{Capabilities: 0x00008000 | 0x00080000} // CLIENT_SECURE_CONNECTION | CLIENT_PLUGIN_AUTH
+
+	var got Handshake
+	if err := Unmarshal(ctx, buf.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(got.AuthPluginDataPart2) != 13 {
+		t.Errorf("len(AuthPluginDataPart2) = %d, want 13", len(got.AuthPluginDataPart2))
+	}
+	if string(got.AuthPluginDataPart2) != string(scramble[8:20])+"\x00" {
+		t.Errorf("AuthPluginDataPart2 = % x, want % x", []byte(got.AuthPluginDataPart2), append(scramble[8:20], 0))
+	}
+	if got.AuthPluginName != "caching_sha2_password" {
+		t.Errorf("AuthPluginName = %q, want %q", got.AuthPluginName, "caching_sha2_password")
+	}
+}
+
+// TestMarshalHandshakeSkipsUnsetCapabilities covers the same packet with
+// neither capability flag set: AuthPluginDataPart2/AuthPluginName must be
+// skipped entirely rather than written as empty strings.
+func TestMarshalHandshakeSkipsUnsetCapabilities(t *testing.T) {
+	scramble := bytes.Repeat([]byte{0x11}, 8)
+
+	pkt := &Handshake{
+		ProtocolVersion:     10,
+		ServerVersion:       "a",
+		ConnectionId:        1,
+		AuthPluginDataPart1: StringFix(scramble),
+		Filler1:             0,
+		CapabilityFlag1:     0,
+		CharacterSet:        33,
+		StatusFlags:         0,
+		CapabilityFlags2:    0,
+		AuthPluginDataLen:   0,
+		Reserved:            "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+	}
+
+	got, err := Marshal(nil, pkt)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	// ProtocolVersion(1) + ServerVersion(2) + ConnectionId(4) +
+	// AuthPluginDataPart1(8) + Filler1(1) + CapabilityFlag1(2) +
+	// CharacterSet(1) + StatusFlags(2) + CapabilityFlags2(2) +
+	// AuthPluginDataLen(1) + Reserved(10) = 34
+	if len(got) != 34 {
+		t.Errorf("len(Marshal(Handshake)) = %d, want 34 (conditional fields should be skipped)", len(got))
+	}
+}
+
+func TestUnmarshalShortBufferReturnsUnexpectedEOF(t *testing.T) {
+	var c OKPacket
+	err := Unmarshal(nil, []byte{0x00}, &c)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Unmarshal with truncated buffer = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestMarshalUnmarshalRoundTripComQuery(t *testing.T) {
+	want := &ComQuery{Command: COM_QUERY, Query: "SELECT * FROM t"}
+
+	data, err := Marshal(nil, want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var got ComQuery
+	if err := Unmarshal(nil, data, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got != *want {
+		t.Errorf("round trip = %+v, want %+v", got, *want)
+	}
+}
+
+func TestMarshalUnmarshalRoundTripStmtPrepareOK(t *testing.T) {
+	want := &StmtPrepareOK{Status: 0, StatementId: 7, NumColumns: 2, NumParams: 1, Reserved: 0, WarningCount: 0}
+
+	data, err := Marshal(nil, want)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	var got StmtPrepareOK
+	if err := Unmarshal(nil, data, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got != *want {
+		t.Errorf("round trip = %+v, want %+v", got, *want)
+	}
+}
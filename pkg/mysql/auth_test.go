@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"dacha-review/pkg/datastore/mysql"
+)
+
+// encodePacket builds a single physical packet (length-prefixed payload),
+// the same framing packetReader.ReadPacket expects.
+func encodePacket(seq int, payload []byte) []byte {
+	header := make([]byte, 4)
+	putUint24(header[0:3], len(payload))
+	header[3] = byte(seq)
+	return append(header, payload...)
+}
+
+// TestAuthenticateConnectionNilCache covers the caching_sha2_password full
+// auth path with a nil AuthConfig.Cache, which used to panic on the
+// unguarded cfg.Cache.Check/Remember calls. A nil Cache should just mean no
+// fast-auth sha2AuthCache is configured, not an authentication failure.
+func TestAuthenticateConnectionNilCache(t *testing.T) {
+	password := "hunter2"
+	first := sha256.Sum256([]byte(password))
+	second := sha256.Sum256(first[:])
+
+	account := &Account{
+		User:           "root",
+		RequiredPlugin: "caching_sha2_password",
+		DoubleSHA256:   second[:],
+	}
+	store := &MemoryCredentialStore{Accounts: map[string]*Account{"root": account}}
+	cfg := &AuthConfig{Store: store, Cache: nil}
+
+	resp := mysql.HandshakeResponse{
+		Username:       mysql.StringNUL("root"),
+		AuthPluginName: mysql.StringNUL("caching_sha2_password"),
+	}
+	scramble := bytes.Repeat([]byte{0x01}, 20)
+
+	pwPacket := encodePacket(2, append([]byte(password), 0))
+	pr := newPacketReader(bytes.NewReader(pwPacket))
+
+	var out bytes.Buffer
+	seq := 1
+	user, ok := authenticateConnection(&out, pr, &seq, resp, scramble, true, cfg)
+	if !ok {
+		t.Fatalf("authenticateConnection() ok = false, want true")
+	}
+	if user != "root" {
+		t.Errorf("user = %q, want %q", user, "root")
+	}
+}
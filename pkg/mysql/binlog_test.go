@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseGTID(t *testing.T) {
+	uuid, txn, err := parseGTID("3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5")
+	if err != nil {
+		t.Fatalf("parseGTID: %v", err)
+	}
+	wantUUID, _ := hex.DecodeString("3E11FA4771CA11E19E33C80AA9429562")
+	if hex.EncodeToString(uuid[:]) != hex.EncodeToString(wantUUID) {
+		t.Errorf("uuid = %x, want %x", uuid, wantUUID)
+	}
+	if txn != 1 {
+		t.Errorf("txn = %d, want 1", txn)
+	}
+}
+
+// TestParseGTIDMultipleGroups covers the "[,...]" form, which should only
+// parse the first UUID:interval group.
+func TestParseGTIDMultipleGroups(t *testing.T) {
+	_, txn, err := parseGTID("3E11FA47-71CA-11E1-9E33-C80AA9429562:1-5,726757ad-4455-11e8-ae04-0242ac110002:10-20")
+	if err != nil {
+		t.Fatalf("parseGTID: %v", err)
+	}
+	if txn != 1 {
+		t.Errorf("txn = %d, want 1", txn)
+	}
+}
+
+func TestParseGTIDMalformed(t *testing.T) {
+	if _, _, err := parseGTID("not-a-gtid"); err == nil {
+		t.Error("parseGTID(malformed) = nil error, want error")
+	}
+}
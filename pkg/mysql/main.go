@@ -4,10 +4,22 @@ import (
 	"fmt"
 	"net"
 	"io"
+	"bufio"
+	"bytes"
+	"strings"
+	"crypto/tls"
+	"crypto/rand"
+	"compress/zlib"
+	"encoding/binary"
 	"encoding/hex"
-	
+	"math"
+	"strconv"
+
 	"database/sql"
     _ "github.com/lib/pq"
+
+	"dacha-review/pkg/datastore/mysql"
+	"dacha-review/pkg/datastore/mysql/dialect"
 )
 
 
@@ -47,93 +59,559 @@ const (
 )
 
 
-// This will handle wrapping the data in a packet 
-func writePacket(conn net.Conn, seq *int, data interface{}) {
-	payload := StringVar(Marshal(data))
-	bin := Marshal(&Packet{ Int3(len(payload)), Int1(*seq), payload })
-	fmt.Println(hex.Dump(bin))
-	conn.Write(bin)
-	*seq += 1
+// maxPacketChunk is the largest payload that fits in one physical packet's
+// mysql.Int3 PayloadLength field (16MB - 1). Logical payloads at or above this size
+// are split across multiple physical packets sharing a contiguous sequence
+// chain; a payload that is an exact multiple of this size must be followed
+// by one more (zero-length) packet so the reader knows where it ends.
+const maxPacketChunk = 0xffffff
+
+// writePacket marshals data and writes it as one or more physical packets.
+func writePacket(w io.Writer, seq *int, data interface{}) {
+	writePacketWithCaps(w, seq, nil, data)
 }
 
-func readPacket(conn net.Conn, seq *int, data *[]byte) error {
-	buf := make([]byte, 512)
-	n, err := conn.Read(buf) // TODO: If n has bytes left, then we got multiple packets
+// writePacketWithCaps is writePacket for the handful of packet types (today,
+// just mysql.Handshake) whose wire layout depends on the connection's negotiated
+// capability flags.
+func writePacketWithCaps(w io.Writer, seq *int, ctx *mysql.CodecCtx, data interface{}) {
+	payload, err := mysql.Marshal(ctx, data)
 	if err != nil {
-		return err
+		fmt.Println("Failed to marshal packet:", err)
+		return
 	}
-	fmt.Println(hex.Dump(buf[0:n]))
-	
-	var pkt Packet
-	UnmarshalPacket(buf, &pkt)
-	
-	if int(pkt.SequenceId) != *seq {
-		fmt.Println("Received out of order packet (expected", seq, "got", pkt.SequenceId, ")")
+	writeRawPacket(w, seq, payload)
+}
+
+func writeRawPacket(w io.Writer, seq *int, payload []byte) {
+	for {
+		chunk := payload
+		if len(chunk) > maxPacketChunk {
+			chunk = chunk[:maxPacketChunk]
+		}
+
+		header := make([]byte, 4)
+		putUint24(header[0:3], len(chunk))
+		header[3] = byte(*seq)
+		*seq += 1
+
+		fmt.Println(hex.Dump(append(header, chunk...)))
+		w.Write(header)
+		w.Write(chunk)
+
+		payload = payload[len(chunk):]
+		if len(chunk) < maxPacketChunk {
+			break
+		}
+		if len(payload) == 0 {
+			// The final chunk exactly filled maxPacketChunk, so an empty
+			// packet is needed to mark the logical payload as complete.
+			writeRawPacket(w, seq, nil)
+			break
+		}
 	}
-	
-	*seq += 1
-	
-	*data = []byte(pkt.Payload)
-	
-	return nil
+}
+
+// packetReader reassembles physical packets read off r into logical MySQL
+// payloads, buffering across short/partial reads and concatenating the
+// multi-fragment chain used for payloads >= 16MB-1. It must be created once
+// per underlying io.Reader and reused across ReadPacket calls so bytes
+// buffered by bufio.Reader are not discarded between packets.
+type packetReader struct {
+	br *bufio.Reader
+}
+
+func newPacketReader(r io.Reader) *packetReader {
+	return &packetReader{br: bufio.NewReader(r)}
+}
+
+func (pr *packetReader) ReadPacket(seq *int) ([]byte, error) {
+	var payload []byte
+
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(pr.br, header); err != nil {
+			return nil, err
+		}
+
+		length := getUint24(header[0:3])
+		gotSeq := int(header[3])
+		if gotSeq != *seq {
+			fmt.Println("Received out of order packet (expected", *seq, "got", gotSeq, ")")
+		}
+		*seq = gotSeq + 1
+
+		body := make([]byte, length)
+		if length > 0 {
+			if _, err := io.ReadFull(pr.br, body); err != nil {
+				return nil, err
+			}
+		}
+		fmt.Println(hex.Dump(append(header, body...)))
+
+		payload = append(payload, body...)
+		if length < maxPacketChunk {
+			break
+		}
+	}
+
+	return payload, nil
 }
 
 // Just sends a generic ok message
-func sendOK(conn net.Conn, seq *int) {
+func sendOK(w io.Writer, seq *int) {
 	fmt.Println("Sending OK")
-	ok := OKPacket{ 0, 0, 0, 2, 0, "" }
-	writePacket(conn, seq, &ok)
+	ok := mysql.OKPacket{Header: 0, AffectedRows: 0, LastInsertId: 0, StatusFlags: 2, Warnings: 0, Info: ""}
+	writePacket(w, seq, &ok)
 }
 
+// translatePlaceholders rewrites a prepared statement's '?' placeholders
+// into Postgres's positional '$1, $2, ...' form. It doesn't try to skip '?'
+// characters inside string literals (the dialect tokenizer in
+// pkg/datastore/mysql/dialect would need to grow an export for that); real
+// client drivers don't send user data as literal '?'s in prepared statement
+// text, so this is good enough for now.
+func translatePlaceholders(query string) string {
+	var out strings.Builder
+	n := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] == '?' {
+			n += 1
+			out.WriteByte('$')
+			out.WriteString(strconv.Itoa(n))
+		} else {
+			out.WriteByte(query[i])
+		}
+	}
+	return out.String()
+}
+
+// decodeBinaryParam turns one COM_STMT_EXECUTE parameter's raw wire bytes
+// (as read by mysql.unmarshalComStmtExecute's binary-protocol decoding) into
+// the Go value to bind when running the statement against the backend,
+// using the MYSQL_TYPE_* most recently negotiated for that parameter index.
+func decodeBinaryParam(raw []byte, types []mysql.StmtParamType, i int) interface{} {
+	var typ uint8
+	if i < len(types) {
+		typ = types[i].Type
+	}
+
+	switch typ {
+	case mysql.MYSQL_TYPE_LONGLONG:
+		if len(raw) != 8 {
+			return string(raw)
+		}
+		if i < len(types) && types[i].Unsigned {
+			return binary.LittleEndian.Uint64(raw)
+		}
+		return int64(binary.LittleEndian.Uint64(raw))
+	case mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_INT24:
+		if len(raw) != 4 {
+			return string(raw)
+		}
+		return int64(int32(binary.LittleEndian.Uint32(raw)))
+	case mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_YEAR:
+		if len(raw) != 2 {
+			return string(raw)
+		}
+		return int64(int16(binary.LittleEndian.Uint16(raw)))
+	case mysql.MYSQL_TYPE_TINY:
+		if len(raw) != 1 {
+			return string(raw)
+		}
+		return int64(int8(raw[0]))
+	case mysql.MYSQL_TYPE_DOUBLE:
+		if len(raw) != 8 {
+			return string(raw)
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(raw))
+	case mysql.MYSQL_TYPE_FLOAT:
+		if len(raw) != 4 {
+			return string(raw)
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(raw)))
+	case mysql.MYSQL_TYPE_DATE, mysql.MYSQL_TYPE_DATETIME, mysql.MYSQL_TYPE_DATETIME2,
+		mysql.MYSQL_TYPE_TIMESTAMP, mysql.MYSQL_TYPE_TIMESTAMP2:
+		if s, ok := decodePackedDateTime(raw); ok {
+			return s
+		}
+		return string(raw)
+	case mysql.MYSQL_TYPE_TIME, mysql.MYSQL_TYPE_TIME2:
+		if s, ok := decodePackedTime(raw); ok {
+			return s
+		}
+		return string(raw)
+	default:
+		// STRING, VAR_STRING, BLOB, DECIMAL, etc. already arrive as
+		// length-decoded text/bytes.
+		return string(raw)
+	}
+}
+
+// decodePackedDateTime decodes a MYSQL_TYPE_DATE/DATETIME/TIMESTAMP
+// binary-protocol value (the packed fields after its length byte, already
+// stripped off by mysql.unmarshalComStmtExecute's param reader):
+// year(2)+month(1)+day(1), optionally followed by hour(1)+minute(1)+
+// second(1), optionally followed by a microsecond(4) field. Returns a
+// Postgres-parseable "YYYY-MM-DD[ HH:MM:SS[.ffffff]]" string.
+// https://dev.mysql.com/doc/internals/en/binary-protocol-value.html
+func decodePackedDateTime(raw []byte) (string, bool) {
+	switch len(raw) {
+	case 0:
+		return "0000-00-00", true
+	case 4, 7, 11:
+		year := binary.LittleEndian.Uint16(raw[0:2])
+		month, day := raw[2], raw[3]
+		s := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+		if len(raw) >= 7 {
+			hour, min, sec := raw[4], raw[5], raw[6]
+			s += fmt.Sprintf(" %02d:%02d:%02d", hour, min, sec)
+		}
+		if len(raw) == 11 {
+			micro := binary.LittleEndian.Uint32(raw[7:11])
+			s += fmt.Sprintf(".%06d", micro)
+		}
+		return s, true
+	default:
+		return "", false
+	}
+}
+
+// decodePackedTime decodes a MYSQL_TYPE_TIME binary-protocol value:
+// is_negative(1)+days(4)+hour(1)+minute(1)+second(1), optionally followed
+// by a microsecond(4) field. Days are folded into the hour count in the
+// returned "[-]HHH:MM:SS[.ffffff]" string, since Postgres's time type has
+// no separate days field the way MySQL's TIME does.
+func decodePackedTime(raw []byte) (string, bool) {
+	switch len(raw) {
+	case 0:
+		return "00:00:00", true
+	case 8, 12:
+		negative := raw[0] != 0
+		days := binary.LittleEndian.Uint32(raw[1:5])
+		hour, min, sec := raw[5], raw[6], raw[7]
+		totalHours := uint32(hour) + days*24
+		sign := ""
+		if negative {
+			sign = "-"
+		}
+		s := fmt.Sprintf("%s%02d:%02d:%02d", sign, totalHours, min, sec)
+		if len(raw) == 12 {
+			micro := binary.LittleEndian.Uint32(raw[8:12])
+			s += fmt.Sprintf(".%06d", micro)
+		}
+		return s, true
+	default:
+		return "", false
+	}
+}
+
+// maxCompressedChunk is the largest payload that fits in one compressed
+// packet's mysql.Int3 compressed_payload_length field (16MB - 1).
+const maxCompressedChunk = 0xffffff
+
+// compressRawThreshold mirrors the real mysqld behavior of not bothering to
+// zlib-compress very small payloads, since the deflate header overhead would
+// make them bigger, not smaller.
+const compressRawThreshold = 50
+
+// compressedConn implements the MySQL compressed protocol (CLIENT_COMPRESS)
+// on top of an existing packet-framed connection: https://dev.mysql.com/doc/internals/en/compressed-packet-header.html
+// It is unaware of the inner MySQL packet boundaries; packetReader/writePacket
+// keep using the same PayloadLength/SequenceId framing as before, just over
+// this Reader/Writer instead of the raw socket.
+type compressedConn struct {
+	rw  io.ReadWriter
+	seq uint8
+
+	readBuf bytes.Buffer
+}
+
+func newCompressedConn(rw io.ReadWriter) *compressedConn {
+	return &compressedConn{rw: rw}
+}
+
+func putUint24(b []byte, v int) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+func getUint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxCompressedChunk {
+			chunk = chunk[:maxCompressedChunk]
+		}
+		if err := c.writeChunk(chunk); err != nil {
+			return total - len(p), err
+		}
+		p = p[len(chunk):]
+	}
+	return total, nil
+}
+
+func (c *compressedConn) writeChunk(chunk []byte) error {
+	payload := chunk
+	uncompressedLen := 0
+
+	if len(chunk) >= compressRawThreshold {
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(chunk)
+		zw.Close()
+
+		// Only use the compressed form if it actually saved space.
+		if compressed.Len() < len(chunk) {
+			payload = compressed.Bytes()
+			uncompressedLen = len(chunk)
+		}
+	}
+
+	header := make([]byte, 7)
+	putUint24(header[0:3], len(payload))
+	header[3] = byte(c.seq)
+	putUint24(header[4:7], uncompressedLen)
+	c.seq += 1
+
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	_, err := c.rw.Write(payload)
+	return err
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	for c.readBuf.Len() == 0 {
+		if err := c.readNextPacket(); err != nil {
+			return 0, err
+		}
+	}
+	return c.readBuf.Read(p)
+}
+
+func (c *compressedConn) readNextPacket() error {
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(c.rw, header); err != nil {
+		return err
+	}
+
+	compressedLen := getUint24(header[0:3])
+	uncompressedLen := getUint24(header[4:7])
+	c.seq = header[3] + 1
+
+	payload := make([]byte, compressedLen)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return err
+	}
+
+	if uncompressedLen == 0 {
+		c.readBuf.Write(payload)
+		return nil
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	out := make([]byte, uncompressedLen)
+	if _, err := io.ReadFull(zr, out); err != nil {
+		return err
+	}
+	c.readBuf.Write(out)
+	return nil
+}
+
+// TLSConfig controls whether the server advertises CLIENT_SSL and how it
+// terminates the upgrade. When nil, TLS is disabled and CLIENT_SSL is never
+// advertised.
+type TLSConfig struct {
+	Config *tls.Config
+
+	// RequireClientCert, when set, requires mutual TLS (the Config's
+	// ClientAuth should be tls.RequireAndVerifyClientCert) and maps the
+	// authenticated connection to a MySQL user using the leaf
+	// certificate's CommonName instead of the mysql.HandshakeResponse username.
+	RequireClientCert bool
+}
+
+// SSLRequest is the short form of HandshakeResponse41 that a client sends
+// first when it intends to upgrade to TLS: only the leading fixed-size
+// fields, none of the variable-length username/database/etc below them.
+// https://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::SSLRequest
+type SSLRequest struct {
+	CapabilityFlag mysql.Int4
+	MaxPacketSize  mysql.Int4
+	CharacterSet   mysql.Int1
+	Reserved       mysql.StringFix `mysql:"len=23"`
+}
+
+// performInitialHandshake runs the MySQL connection-phase handshake on conn.
+// If tlsCfg is non-nil and the client requests CLIENT_SSL, conn is upgraded
+// to TLS midway through and the returned io.ReadWriter and *packetReader are
+// the TLS connection's; all later reads/writes on this connection must go
+// through the returned values rather than conn directly. certCN is the
+// client certificate's CommonName when RequireClientCert mapped the user,
+// else "". If authCfg is non-nil, the client must additionally pass the
+// caching_sha2_password/mysql_native_password negotiation in
+// authenticateConnection; user/authOK report the outcome, and a connection
+// that fails authentication should be closed by the caller without
+// proceeding to the command phase.
+func performInitialHandshake(conn net.Conn, id int, tlsCfg *TLSConfig, authCfg *AuthConfig) (rw io.ReadWriter, pr *packetReader, resp mysql.HandshakeResponse, certCN string, user string, authOK bool) {
 
-func performInitialHandshake(conn net.Conn, id int) {
-	
 	seq := 0
-	
-	writePacket(conn, &seq, &Handshake{
+	rw = conn
+	pr = newPacketReader(conn)
+	upgradedTLS := false
+
+	// The handshake's auth-plugin-data doubles as the scramble that
+	// mysql_native_password/caching_sha2_password mix into their response
+	// hashes, so it must be fresh per connection.
+	scramble := make([]byte, 20)
+	rand.Read(scramble)
+
+	capabilities1 := mysql.Int2(0xffff &^ (CLIENT_SSL))
+	if tlsCfg != nil {
+		capabilities1 |= CLIENT_SSL
+	}
+	capabilities2 := mysql.Int2((CLIENT_DEPRECATE_EOF >> 16) | (49663 &^ (CLIENT_SESSION_TRACK >> 16))) // All // mysql.Int2((capabilities >> 16) & 0xffff), //,
+
+	handshakeCtx := &mysql.CodecCtx{Capabilities: uint32(capabilities1) | (uint32(capabilities2) << 16)}
+
+	writePacketWithCaps(rw, &seq, handshakeCtx, &mysql.Handshake{
 		ProtocolVersion: 10,
 		ServerVersion: "5.7.19",
-		ConnectionId: Int4(id),
-		AuthPluginDataPart1: "12345678", // len=8 // TODO
+		ConnectionId: mysql.Int4(id),
+		AuthPluginDataPart1: mysql.StringFix(scramble[0:8]),
 		Filler1: 0,
-		CapabilityFlag1: (0xffff &^ (CLIENT_COMPRESS | CLIENT_SSL)),
+		CapabilityFlag1: capabilities1,
 		CharacterSet: UTF8_GENERAL_CI,
 		StatusFlags: 2,
-		CapabilityFlags2: ((CLIENT_DEPRECATE_EOF >> 16) | (49663 &^ (CLIENT_SESSION_TRACK >> 16))), // All // Int2((capabilities >> 16) & 0xffff), //,
+		CapabilityFlags2: capabilities2,
 		AuthPluginDataLen: 21, // The total data length should be 20 for the secure connection method
 		Reserved: "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
-		AuthPluginDataPart2: "123456789abc\x00",
-		AuthPluginName: "mysql_native_password", // TODO
+		AuthPluginDataPart2: mysql.StringVar(string(scramble[8:20]) + "\x00"),
+		AuthPluginName: "caching_sha2_password",
 	})
-	
-	var buf []byte
-	readPacket(conn, &seq, &buf)
-	
-	var resp HandshakeResponse
-	Unmarshal(buf, &resp)
-	// TODO: Do something with the response
 
-	sendOK(conn, &seq)
+	buf, _ := pr.ReadPacket(&seq)
+
+	// The SSLRequest packet is exactly 32 bytes (no trailing variable-length
+	// fields); a full HandshakeResponse41 is always longer than that since
+	// it carries at least a NUL-terminated username.
+	if tlsCfg != nil && len(buf) == 32 {
+		var sslReq SSLRequest
+		if err := mysql.Unmarshal(nil, buf, &sslReq); err != nil {
+			fmt.Println("Failed to decode SSLRequest:", err)
+			return rw, pr, resp, "", "", false
+		}
+
+		if uint32(sslReq.CapabilityFlag)&CLIENT_SSL != 0 {
+			tlsConn := tls.Server(conn, tlsCfg.Config)
+			if err := tlsConn.Handshake(); err != nil {
+				fmt.Println("TLS handshake failed:", err)
+				return rw, pr, resp, "", "", false
+			}
+			rw = tlsConn
+			pr = newPacketReader(tlsConn)
+			upgradedTLS = true
+
+			if tlsCfg.RequireClientCert {
+				state := tlsConn.ConnectionState()
+				if len(state.PeerCertificates) > 0 {
+					certCN = state.PeerCertificates[0].Subject.CommonName
+				}
+			}
+
+			// The client now re-sends the full HandshakeResponse41 over
+			// the upgraded connection, continuing the sequence after the
+			// SSLRequest's id.
+			buf, _ = pr.ReadPacket(&seq)
+		}
+	}
+
+	if tlsCfg != nil && tlsCfg.RequireClientCert && certCN == "" {
+		fmt.Println("Client certificate required but none was presented")
+		return rw, pr, resp, "", "", false
+	}
+
+	if len(buf) < 4 {
+		return rw, pr, resp, certCN, "", false
+	}
+	// The capability flags are the first field of HandshakeResponse41 itself,
+	// so they have to be read out before the rest of the struct can be
+	// decoded, to know whether its later `if=`-tagged fields are present.
+	respCtx := &mysql.CodecCtx{Capabilities: binary.LittleEndian.Uint32(buf[0:4])}
+	if err := mysql.Unmarshal(respCtx, buf, &resp); err != nil {
+		fmt.Println("Failed to decode HandshakeResponse:", err)
+		return rw, pr, resp, certCN, "", false
+	}
+
+	if certCN != "" {
+		// A validated client certificate already proves identity under
+		// mutual TLS, so it determines the authenticated user directly
+		// instead of also running the password-based auth-plugin
+		// negotiation below, overriding whatever HandshakeResponse.Username
+		// the client happened to send.
+		user = certCN
+		authOK = true
+	} else if authCfg != nil {
+		user, authOK = authenticateConnection(rw, pr, &seq, resp, scramble, upgradedTLS, authCfg)
+		if !authOK {
+			writePacket(rw, &seq, &mysql.ERRPacket{Header: 0xff, ErrorCode: 0x15b8, SqlStateMarker: "#", SqlState: "28000", ErrorMessage: mysql.StringEOF("Access denied for user '" + user + "'")})
+			return rw, pr, resp, certCN, user, false
+		}
+	} else {
+		user = string(resp.Username)
+		authOK = true
+	}
+
+	sendOK(rw, &seq)
+
+	return rw, pr, resp, certCN, user, authOK
 }
 
 
 
 
-func handleConnection(conn net.Conn, id int) {
+func handleConnection(conn net.Conn, id int, tlsCfg *TLSConfig, authCfg *AuthConfig, binlogSource BinlogSource) {
 	// Making a companion connection to CockroachDB
 	db, err := sql.Open("postgres", "postgresql://root@localhost:26257/wordpress?sslmode=disable")
 	if err != nil {
 		fmt.Println("error connecting to the database: ", err)
 	}
-	
+
 	defer conn.Close()
-	
-	
+
+
 	r, e := db.Query("USE wordpress")
 	fmt.Println(r, e)
-	
-	
-	performInitialHandshake(conn, id)
+
+
+	rw, pr, resp, certCN, user, authOK := performInitialHandshake(conn, id, tlsCfg, authCfg)
+	if !authOK {
+		fmt.Println("Authentication failed for user", user)
+		return
+	}
+	if certCN != "" {
+		fmt.Println("Authenticated via client certificate as", certCN)
+	}
+
+	if uint32(resp.CapabilityFlag)&CLIENT_COMPRESS != 0 {
+		// packetReader/writePacket keep operating on mysql.Packet-framed bytes; they
+		// stay unaware that those bytes are now further wrapped in the
+		// zlib compressed packet framing.
+		cc := newCompressedConn(rw)
+		rw = cc
+		pr = newPacketReader(cc)
+	}
 
 	//fmt.Println("Handshake:")
 	//fmt.Println("----------")
@@ -142,102 +620,274 @@ func handleConnection(conn net.Conn, id int) {
 	
 
 	// At this point we have authenticated and are in command phase
-	
-	
-	var buf []byte
+
+	statements := map[uint32]*mysql.PreparedStatement{}
+	var nextStmtId uint32 = 1
+
 	for {
 		seq := 0
-		err := readPacket(conn, &seq, &buf)
+		buf, err := pr.ReadPacket(&seq)
         if err != nil {
             if err != io.EOF {
                 fmt.Println("read error:", err)
             }
             break
         }
-				
-		
-		cmd := UnmarshalCommand(buf)
-		
+
+
+		cmd, err := mysql.UnmarshalCommand(buf, statements)
+		if err != nil {
+			fmt.Println("Failed to decode command:", err)
+			writePacket(rw, &seq, &mysql.ERRPacket{Header: 0xff, ErrorCode: 0x1047, SqlStateMarker: "#", SqlState: "08S01", ErrorMessage: mysql.StringEOF(err.Error())})
+			continue
+		}
+
 		switch cmd.(type) {
-		case ComQuit:
+		case mysql.ComQuit:
 			fmt.Println("Connection quiting...")
 			break
-		case ComInitDB:
-			sendOK(conn, &seq)
+		case mysql.ComInitDB:
+			sendOK(rw, &seq)
+
+		case mysql.ComStmtPrepare:
+			c := cmd.(mysql.ComStmtPrepare)
+
+			numParams := strings.Count(string(c.Query), "?")
+			rewrittenQuery, rewriteArgs := dialect.Default.RewriteQuery(translatePlaceholders(string(c.Query)))
+
+			// Only a SELECT actually returns result columns; describing it
+			// means running it against the backend with untyped NULL
+			// params, so skip that for anything else to avoid double-
+			// running an INSERT/UPDATE/DELETE's side effects here and
+			// again on COM_STMT_EXECUTE.
+			numColumns := 0
+			if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(rewrittenQuery)), "SELECT") {
+				describeArgs := append(append([]interface{}{}, rewriteArgs...), make([]interface{}, numParams)...)
+				if rows, err := db.Query(rewrittenQuery, describeArgs...); err == nil {
+					if colTypes, err := rows.ColumnTypes(); err == nil {
+						numColumns = len(colTypes)
+					}
+					rows.Close()
+				}
+			}
+
+			stmt := &mysql.PreparedStatement{
+				StatementId:    nextStmtId,
+				Query:          string(c.Query),
+				RewrittenQuery: rewrittenQuery,
+				RewriteArgs:    rewriteArgs,
+				NumParams:      numParams,
+				NumColumns:     numColumns,
+			}
+			statements[nextStmtId] = stmt
+			nextStmtId += 1
+
+			writePacket(rw, &seq, &mysql.StmtPrepareOK{
+				Status:       0,
+				StatementId:  mysql.Int4(stmt.StatementId),
+				NumColumns:   mysql.Int2(stmt.NumColumns),
+				NumParams:    mysql.Int2(stmt.NumParams),
+				Reserved:     0,
+				WarningCount: 0,
+			})
+			for i := 0; i < stmt.NumParams; i++ {
+				writePacket(rw, &seq, &mysql.ResultSetColumnDefinition{
+					Catalog: "def", Name: "?", FixedLength: 0x0c,
+					CharacterSet: UTF8_GENERAL_CI, ColumnLength: 0,
+					Type: mysql.MYSQL_TYPE_VAR_STRING, Flags: 0, Decimals: 0,
+				})
+			}
+			if stmt.NumParams > 0 {
+				writePacket(rw, &seq, &mysql.EOFPacket{Header: 0xfe, Warnings: 0, StatusFlags: 2})
+			}
+			for i := 0; i < stmt.NumColumns; i++ {
+				writePacket(rw, &seq, &mysql.ResultSetColumnDefinition{
+					Catalog: "def", Name: "col", FixedLength: 0x0c,
+					CharacterSet: UTF8_GENERAL_CI, ColumnLength: 0,
+					Type: mysql.MYSQL_TYPE_VAR_STRING, Flags: 0, Decimals: 0,
+				})
+			}
+			if stmt.NumColumns > 0 {
+				writePacket(rw, &seq, &mysql.EOFPacket{Header: 0xfe, Warnings: 0, StatusFlags: 2})
+			}
+
+		case mysql.ComStmtExecute:
+			c := cmd.(mysql.ComStmtExecute)
+			stmt, ok := statements[uint32(c.StatementId)]
+			if !ok {
+				writePacket(rw, &seq, &mysql.ERRPacket{Header: 0xff, ErrorCode: 0x1243, SqlStateMarker: "#", SqlState: "HY000", ErrorMessage: mysql.StringEOF("Unknown prepared statement handle")})
+				continue
+			}
+
+			args := append([]interface{}{}, stmt.RewriteArgs...)
+			for i, raw := range c.Params {
+				if long, ok := stmt.LongData[i]; ok {
+					raw = long
+				}
+				if raw == nil {
+					args = append(args, nil)
+					continue
+				}
+				args = append(args, decodeBinaryParam(raw, stmt.ParamTypes, i))
+			}
+			stmt.LongData = nil
+
+			rows, err := db.Query(stmt.RewrittenQuery, args...)
+			if err != nil {
+				writePacket(rw, &seq, &mysql.ERRPacket{Header: 0xff, ErrorCode: 0x0448, SqlStateMarker: "#", SqlState: "HY000", ErrorMessage: mysql.StringEOF(err.Error())})
+				continue
+			}
+
+			colTypes, err := rows.ColumnTypes()
+			if err != nil {
+				writePacket(rw, &seq, &mysql.ERRPacket{Header: 0xff, ErrorCode: 0x0448, SqlStateMarker: "#", SqlState: "HY000", ErrorMessage: mysql.StringEOF(err.Error())})
+				rows.Close()
+				continue
+			}
+
+			writePacket(rw, &seq, &mysql.ResultSetHeader{ColumnCount: mysql.IntVar(len(colTypes))})
+
+			for _, col := range colTypes {
+				writePacket(rw, &seq, &mysql.ResultSetColumnDefinition{
+					Catalog:      "def",
+					Name:         mysql.StringLenEnc(col.Name()),
+					OrgName:      mysql.StringLenEnc(col.Name()),
+					FixedLength:  0x0c,
+					CharacterSet: UTF8_GENERAL_CI,
+					ColumnLength: 192,
+					Type:         mysql.Int1(dialect.Default.RewriteColumnType(col.DatabaseTypeName())),
+					Flags:        0,
+					Decimals:     0,
+					Filler:       0,
+				})
+			}
+			writePacket(rw, &seq, &mysql.EOFPacket{Header: 0xfe, Warnings: 0, StatusFlags: 2})
+
+			values := make([]sql.NullString, len(colTypes))
+			scanArgs := make([]interface{}, len(colTypes))
+			for i := range values {
+				scanArgs[i] = &values[i]
+			}
+
+			for rows.Next() {
+				if err := rows.Scan(scanArgs...); err != nil {
+					fmt.Println("Error", err)
+					continue
+				}
+
+				// TODO: encode each value per its actual MYSQL_TYPE_*
+				// (fixed-width for numeric types) instead of always
+				// length-encoding it as a string; same simplification as
+				// the text protocol's COM_QUERY result rows below.
+				rowValues := make([][]byte, len(values))
+				for i, v := range values {
+					if v.Valid {
+						rowValues[i] = mysql.EncodeLenEncBytes([]byte(v.String))
+					}
+				}
+				writeRawPacket(rw, &seq, mysql.MarshalBinaryResultSetRow(rowValues))
+			}
+			rows.Close()
+
+			writePacket(rw, &seq, &mysql.EOFPacket{Header: 0xfe, Warnings: 0, StatusFlags: 2})
+
+		case mysql.ComStmtClose:
+			// Statement was already removed from the map by mysql.UnmarshalCommand.
 		
-		case ComQuery:
-			c := cmd.(ComQuery)
+		case mysql.ComQuery:
+			c := cmd.(mysql.ComQuery)
 			fmt.Println("Going to query:", c.Query)
-			
+
 			// TODO: Eventually send the entire response as a single network packet if possible
-			
-			//sendOK(conn, &seq)
-			
-			// Common functions: https://www.postgresql.org/docs/9.2/static/functions-info.html
-			if c.Query == "select @@version_comment limit 1" {
-				c.Query = "SELECT version()"
-			}
-			
-			if c.Query == "SELECT DATABASE()" {
-				c.Query = "SELECT current_database()"
-				// TODO: Will also need to remap it in the output
+
+			query, args := dialect.Default.RewriteQuery(string(c.Query))
+
+			rows, err := db.Query(query, args...)
+
+			if err != nil {
+				writePacket(rw, &seq, &mysql.ERRPacket{Header: 0xff, ErrorCode: 0x0448, SqlStateMarker: "#", SqlState: "HY000", ErrorMessage: mysql.StringEOF(err.Error())})
+				continue
 			}
-			
-			
-			writePacket(conn, &seq, &ResultSetHeader{ 1 })
-			
-			writePacket(conn, &seq, &ResultSetColumnDefinition{
-				Catalog: "def",
-				Schema: "",
-				Table: "",
-				OrgTable: "",
-				Name: "Database",
-				OrgName: "",
-				FixedLength: 0x0c,
-				CharacterSet: UTF8_GENERAL_CI,
-				ColumnLength: 192,
-				Type: MYSQL_TYPE_VAR_STRING,
-				Flags: 0x01, // not null
-				Decimals: 0,
-				Filler: 0,
-			});
-			
-			//writePacket(conn, &seq, &EOFPacket{ 0xfe, 0, 2 })
-			
-			
-			rows, err := db.Query(string(c.Query))
-			
+
+			colTypes, err := rows.ColumnTypes()
 			if err != nil {
-				writePacket(conn, &seq, &ERRPacket{ 0xff, 0x0448, "#", "HY000", StringEOF(err.Error()) })
+				writePacket(rw, &seq, &mysql.ERRPacket{Header: 0xff, ErrorCode: 0x0448, SqlStateMarker: "#", SqlState: "HY000", ErrorMessage: mysql.StringEOF(err.Error())})
+				rows.Close()
 				continue
 			}
-			
-			fmt.Println(rows)
-			fmt.Println(err)
-			fmt.Println("-------")
-			fmt.Println(rows.Columns())
-			//defer rows.Close()
+
+			writePacket(rw, &seq, &mysql.ResultSetHeader{ColumnCount: mysql.IntVar(len(colTypes))})
+
+			for _, col := range colTypes {
+				writePacket(rw, &seq, &mysql.ResultSetColumnDefinition{
+					Catalog: "def",
+					Schema: "",
+					Table: "",
+					OrgTable: "",
+					Name: mysql.StringLenEnc(col.Name()),
+					OrgName: mysql.StringLenEnc(col.Name()),
+					FixedLength: 0x0c,
+					CharacterSet: UTF8_GENERAL_CI,
+					ColumnLength: 192,
+					Type: mysql.Int1(dialect.Default.RewriteColumnType(col.DatabaseTypeName())),
+					Flags: 0,
+					Decimals: 0,
+					Filler: 0,
+				});
+			}
+
+			values := make([]sql.NullString, len(colTypes))
+			scanArgs := make([]interface{}, len(colTypes))
+			for i := range values {
+				scanArgs[i] = &values[i]
+			}
+
 			for rows.Next() {
-				var str string
-				if err := rows.Scan(&str); err != nil {
-					//log.Fatal(err)
-					fmt.Println("Error",err)
+				if err := rows.Scan(scanArgs...); err != nil {
+					fmt.Println("Error", err)
+					continue
 				}
-				
-				writePacket(conn, &seq, &ResultSetRow{ StringLenEnc(str) })
-				//fmt.Printf("%d %d\n", id, balance)
+
+				// TODO: mysql.ResultSetRow only has one field, so only the first
+				// column round-trips correctly; mysql.Marshal's struct tags
+				// have no way to express a variable number of fields.
+				row := &mysql.ResultSetRow{}
+				if len(values) > 0 {
+					row.Field1 = mysql.StringLenEnc(values[0].String)
+				}
+				writePacket(rw, &seq, row)
 			}
 			rows.Close()
+
+			writePacket(rw, &seq, &mysql.EOFPacket{Header: 0xfe, Warnings: 0, StatusFlags: 2})
 			
-			//writePacket(conn, &seq, &ResultSetRow{ "wordpress" })
-			
-			writePacket(conn, &seq, &EOFPacket{ 0xfe, 0, 2 })
-			//sendOK(conn, &seq)
-			
-		case ComFieldList:
+		case mysql.ComFieldList:
 			// Just send back that there are no fields
-			writePacket(conn, &seq, &EOFPacket{ 0xfe, 0, 2 })
-			
+			writePacket(rw, &seq, &mysql.EOFPacket{Header: 0xfe, Warnings: 0, StatusFlags: 2})
+
+		case mysql.ComRegisterSlave:
+			// Nothing to track beyond the ack: this server doesn't expose
+			// SHOW SLAVE HOSTS, so there's no registry to add c to.
+			sendOK(rw, &seq)
+
+		case mysql.ComBinlogDump:
+			c := cmd.(mysql.ComBinlogDump)
+			if binlogSource == nil {
+				writePacket(rw, &seq, &mysql.ERRPacket{Header: 0xff, ErrorCode: 0x0458, SqlStateMarker: "#", SqlState: "HY000", ErrorMessage: mysql.StringEOF("This server is not configured with a binlog source")})
+				continue
+			}
+			streamBinlog(rw, &seq, uint32(c.ServerId), "", binlogSource)
+			return
+
+		case mysql.ComBinlogDumpGTID:
+			c := cmd.(mysql.ComBinlogDumpGTID)
+			if binlogSource == nil {
+				writePacket(rw, &seq, &mysql.ERRPacket{Header: 0xff, ErrorCode: 0x0458, SqlStateMarker: "#", SqlState: "HY000", ErrorMessage: mysql.StringEOF("This server is not configured with a binlog source")})
+				continue
+			}
+			streamBinlog(rw, &seq, uint32(c.ServerId), c.GTIDSet, binlogSource)
+			return
+
 		}
 		
 	}
@@ -256,16 +906,30 @@ func main() {
 	*/
 	
 	fmt.Println("Starting")
-	
+
 	listener, err := net.Listen("tcp", ":3306")
 	if err != nil {
 		fmt.Println("Failed", err)
 		return
 		// return errors.Wrap(err, "Unable to listen on " + listener.Addr().String() + "\n")
 	}
-	
+
+	// TODO: Load cert/key/CA from config and set tlsCfg to enable CLIENT_SSL;
+	// leaving it nil disables TLS entirely.
+	var tlsCfg *TLSConfig = nil
+
+	// TODO: Wire up a real CredentialStore and RSA keypair and set authCfg
+	// to require authentication; leaving it nil accepts every client like
+	// this server has always done.
+	var authCfg *AuthConfig = nil
+
+	// TODO: Wire this up to the CockroachDB changefeed backing db and set
+	// binlogSource to support COM_REGISTER_SLAVE/COM_BINLOG_DUMP_GTID;
+	// leaving it nil rejects replica connections with an mysql.ERRPacket.
+	var binlogSource BinlogSource = nil
+
 	nconns := 0
-	
+
 	fmt.Println("Listening on", listener.Addr().String())
 	for {
 		// log.Println("Accept a connection request.")
@@ -276,8 +940,8 @@ func main() {
 		}
 		fmt.Println("Handle incoming messages.")
 		nconns += 1
-		
-		go handleConnection(conn, nconns)
+
+		go handleConnection(conn, nconns, tlsCfg, authCfg, binlogSource)
 	}
 	
 	